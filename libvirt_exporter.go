@@ -19,25 +19,42 @@ package main
 
 import (
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
 
 	kingpin "github.com/alecthomas/kingpin/v2"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
+	versioncollector "github.com/prometheus/client_golang/prometheus/collectors/version"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/promlog"
 	"github.com/prometheus/common/promlog/flag"
 	"github.com/prometheus/common/version"
 	"github.com/prometheus/exporter-toolkit/web"
 	webflag "github.com/prometheus/exporter-toolkit/web/kingpinflag"
 	"github.com/prometheus/procfs"
+	"golang.org/x/sync/singleflight"
 	"libvirt.org/go/libvirt"
 
 	"github.com/ntk148v/libvirt-exporter/pkg/libvirtSchema"
@@ -45,366 +62,1403 @@ import (
 )
 
 var (
+	libvirtUpDesc                         *prometheus.Desc
+	libvirtUpErrorDesc                    *prometheus.Desc
+	libvirtLastScrapeSuccessDesc          *prometheus.Desc
+	libvirtCacheHitDesc                   *prometheus.Desc
+	libvirtCacheAgeDesc                   *prometheus.Desc
+	libvirtCollectCursorDesc              *prometheus.Desc
+	libvirtPoolInfoCapacity               *prometheus.Desc
+	libvirtPoolInfoAllocation             *prometheus.Desc
+	libvirtPoolInfoAvailable              *prometheus.Desc
+	libvirtPoolInfoUsedRatio              *prometheus.Desc
+	libvirtPoolInfoAutostart              *prometheus.Desc
+	libvirtPoolInfoPersistent             *prometheus.Desc
+	libvirtPoolRefreshDuration            *prometheus.Desc
+	libvirtPoolRefreshErrors              *prometheus.Desc
+	libvirtNodeDeviceInfoDesc             *prometheus.Desc
+	libvirtNodeDeviceMdevAvailableDesc    *prometheus.Desc
+	libvirtVersionsInfoDesc               *prometheus.Desc
+	libvirtDomainInfoMetaDesc             *prometheus.Desc
+	libvirtDomainInfoMaxMemBytesDesc      *prometheus.Desc
+	libvirtDomainInfoMemoryUsageBytesDesc *prometheus.Desc
+	libvirtDomainInfoNrVirtCPUDesc        *prometheus.Desc
+	libvirtDomainInfoVcpuMaxDesc          *prometheus.Desc
+	libvirtDomainInfoCPUTimeDesc          *prometheus.Desc
+	libvirtDomainInfoVirDomainState       *prometheus.Desc
+	libvirtDomainStateDesc                *prometheus.Desc
+	libvirtDomainInTransientStateDesc     *prometheus.Desc
+	libvirtDomainInfoStateReasonDesc      *prometheus.Desc
+	libvirtDomainTPMPresentDesc           *prometheus.Desc
+	libvirtDomainSecureBootEnabledDesc    *prometheus.Desc
+	libvirtDomainWatchdogPresentDesc      *prometheus.Desc
+	libvirtDomainRNGPresentDesc           *prometheus.Desc
+	libvirtDomainControllerInfoDesc       *prometheus.Desc
+	libvirtDomainPeripheralInfoDesc       *prometheus.Desc
+	libvirtDomainHostdevInfoDesc          *prometheus.Desc
+	libvirtDomainFilesystemInfoDesc       *prometheus.Desc
+	libvirtDomainChannelInfoDesc          *prometheus.Desc
+	libvirtDomainGuestAgentConnectedDesc  *prometheus.Desc
+	libvirtDomainVsockInfoDesc            *prometheus.Desc
+	libvirtDomainHyperVFeatureDesc        *prometheus.Desc
+	libvirtDomainPerfEventsDesc           *prometheus.Desc
+	libvirtDomainBootOrderDesc            *prometheus.Desc
+	libvirtDomainSnapshotsDesc            *prometheus.Desc
+	libvirtDomainGraphicsInfoDesc         *prometheus.Desc
+	libvirtDomainVideoInfoDesc            *prometheus.Desc
+	libvirtDomainScrapeDurationDesc       *prometheus.Desc
+	libvirtDomainProcessResidentMemDesc   *prometheus.Desc
+	libvirtDomainProcessCPUSecondsDesc    *prometheus.Desc
+	libvirtDomainProcessOpenFDsDesc       *prometheus.Desc
+	libvirtDomainProcessMaxFDsDesc        *prometheus.Desc
+	libvirtDomainLifecycleEventDesc       *prometheus.Desc
+	libvirtDomainMemoryBackingInfoDesc    *prometheus.Desc
+	libvirtDomainMemoryHugepageBackedDesc *prometheus.Desc
+	libvirtDomainOSInfoDesc               *prometheus.Desc
+	libvirtDomainCPUInfoDesc              *prometheus.Desc
+	libvirtDomainCPUTopologyDesc          *prometheus.Desc
+	libvirtDomainConfigHashDesc           *prometheus.Desc
+	libvirtDomainSecLabelInfoDesc         *prometheus.Desc
+
+	libvirtDomainVcpuTimeDesc    *prometheus.Desc
+	libvirtDomainVcpuDelayDesc   *prometheus.Desc
+	libvirtDomainVcpuStateDesc   *prometheus.Desc
+	libvirtDomainVcpuCPUDesc     *prometheus.Desc
+	libvirtDomainVcpuCPUTimeDesc *prometheus.Desc
+	libvirtDomainVcpuWaitDesc    *prometheus.Desc
+	libvirtDomainVcpuStealDesc   *prometheus.Desc
+
+	libvirtDomainEmulatorPinDesc     *prometheus.Desc
+	libvirtDomainIOThreadPinDesc     *prometheus.Desc
+	libvirtDomainNumatuneModeDesc    *prometheus.Desc
+	libvirtDomainNumatuneNodesetDesc *prometheus.Desc
+
+	libvirtDomainMetaBlockDesc                  *prometheus.Desc
+	libvirtDomainBlockQueuesDesc                *prometheus.Desc
+	libvirtDomainBlockIOThreadDesc              *prometheus.Desc
+	libvirtDomainBlockHostIOInflightDesc        *prometheus.Desc
+	libvirtDomainBlockHostIOTimeDesc            *prometheus.Desc
+	libvirtDomainBlockHostIOTimeWeightedDesc    *prometheus.Desc
+	libvirtDomainBlockHWInfoDesc                *prometheus.Desc
+	libvirtDomainBlockRdBytesDesc               *prometheus.Desc
+	libvirtDomainBlockRdReqDesc                 *prometheus.Desc
+	libvirtDomainBlockRdTotalTimeSecondsDesc    *prometheus.Desc
+	libvirtDomainBlockWrBytesDesc               *prometheus.Desc
+	libvirtDomainBlockWrReqDesc                 *prometheus.Desc
+	libvirtDomainBlockWrTotalTimesDesc          *prometheus.Desc
+	libvirtDomainBlockRdLatencySecondsDesc      *prometheus.Desc
+	libvirtDomainBlockWrLatencySecondsDesc      *prometheus.Desc
+	libvirtDomainBlockRdIopsDesc                *prometheus.Desc
+	libvirtDomainBlockWrIopsDesc                *prometheus.Desc
+	libvirtDomainBlockRdBytesPerSecondDesc      *prometheus.Desc
+	libvirtDomainBlockWrBytesPerSecondDesc      *prometheus.Desc
+	libvirtDomainBlockFlushReqDesc              *prometheus.Desc
+	libvirtDomainBlockFlushTotalTimeSecondsDesc *prometheus.Desc
+	libvirtDomainBlockAllocationDesc            *prometheus.Desc
+	libvirtDomainBlockCapacityBytesDesc         *prometheus.Desc
+	libvirtDomainBlockPhysicalSizeBytesDesc     *prometheus.Desc
+	libvirtDomainBlockUsedRatioDesc             *prometheus.Desc
+
+	// Block IO tune parameters
+	// Limits
+	libvirtDomainBlockTotalBytesSecDesc *prometheus.Desc
+	libvirtDomainBlockWriteBytesSecDesc *prometheus.Desc
+	libvirtDomainBlockReadBytesSecDesc  *prometheus.Desc
+	libvirtDomainBlockTotalIopsSecDesc  *prometheus.Desc
+	libvirtDomainBlockWriteIopsSecDesc  *prometheus.Desc
+	libvirtDomainBlockReadIopsSecDesc   *prometheus.Desc
+	// Burst limits
+	libvirtDomainBlockTotalBytesSecMaxDesc       *prometheus.Desc
+	libvirtDomainBlockWriteBytesSecMaxDesc       *prometheus.Desc
+	libvirtDomainBlockReadBytesSecMaxDesc        *prometheus.Desc
+	libvirtDomainBlockTotalIopsSecMaxDesc        *prometheus.Desc
+	libvirtDomainBlockWriteIopsSecMaxDesc        *prometheus.Desc
+	libvirtDomainBlockReadIopsSecMaxDesc         *prometheus.Desc
+	libvirtDomainBlockTotalBytesSecMaxLengthDesc *prometheus.Desc
+	libvirtDomainBlockWriteBytesSecMaxLengthDesc *prometheus.Desc
+	libvirtDomainBlockReadBytesSecMaxLengthDesc  *prometheus.Desc
+	libvirtDomainBlockTotalIopsSecMaxLengthDesc  *prometheus.Desc
+	libvirtDomainBlockWriteIopsSecMaxLengthDesc  *prometheus.Desc
+	libvirtDomainBlockReadIopsSecMaxLengthDesc   *prometheus.Desc
+	libvirtDomainBlockIoTuneGroupDesc            *prometheus.Desc
+	libvirtDomainBlockSizeIopsSecDesc            *prometheus.Desc
+
+	libvirtDomainBlkioWeightDesc       *prometheus.Desc
+	libvirtDomainBlkioDeviceWeightDesc *prometheus.Desc
+
+	libvirtDomainMetaInterfacesDesc            *prometheus.Desc
+	libvirtDomainInterfaceRxBytesDesc          *prometheus.Desc
+	libvirtDomainInterfaceRxPacketsDesc        *prometheus.Desc
+	libvirtDomainInterfaceRxErrsDesc           *prometheus.Desc
+	libvirtDomainInterfaceRxDropDesc           *prometheus.Desc
+	libvirtDomainInterfaceTxBytesDesc          *prometheus.Desc
+	libvirtDomainInterfaceTxPacketsDesc        *prometheus.Desc
+	libvirtDomainInterfaceTxErrsDesc           *prometheus.Desc
+	libvirtDomainInterfaceTxDropDesc           *prometheus.Desc
+	libvirtDomainInterfaceHostRxBytesDesc      *prometheus.Desc
+	libvirtDomainInterfaceHostRxPktsDesc       *prometheus.Desc
+	libvirtDomainInterfaceHostRxErrsDesc       *prometheus.Desc
+	libvirtDomainInterfaceHostRxDropDesc       *prometheus.Desc
+	libvirtDomainInterfaceHostTxBytesDesc      *prometheus.Desc
+	libvirtDomainInterfaceHostTxPktsDesc       *prometheus.Desc
+	libvirtDomainInterfaceHostTxErrsDesc       *prometheus.Desc
+	libvirtDomainInterfaceHostTxDropDesc       *prometheus.Desc
+	libvirtDomainInterfaceHostRxFifoDesc       *prometheus.Desc
+	libvirtDomainInterfaceHostRxMulticastDesc  *prometheus.Desc
+	libvirtDomainInterfaceHostRxCompressedDesc *prometheus.Desc
+	libvirtDomainInterfaceHostTxFifoDesc       *prometheus.Desc
+	libvirtDomainInterfaceHostTxCompressedDesc *prometheus.Desc
+	libvirtDomainInterfaceRxBitsDesc           *prometheus.Desc
+	libvirtDomainInterfaceTxBitsDesc           *prometheus.Desc
+
+	libvirtDomainInterfaceInboundAverageDesc  *prometheus.Desc
+	libvirtDomainInterfaceInboundPeakDesc     *prometheus.Desc
+	libvirtDomainInterfaceInboundBurstDesc    *prometheus.Desc
+	libvirtDomainInterfaceOutboundAverageDesc *prometheus.Desc
+	libvirtDomainInterfaceOutboundPeakDesc    *prometheus.Desc
+	libvirtDomainInterfaceOutboundBurstDesc   *prometheus.Desc
+	libvirtDomainInterfaceQueuesDesc          *prometheus.Desc
+
+	libvirtDomainMemoryStatMajorFaultTotalDesc   *prometheus.Desc
+	libvirtDomainMemoryStatMinorFaultTotalDesc   *prometheus.Desc
+	libvirtDomainMemoryStatUnusedBytesDesc       *prometheus.Desc
+	libvirtDomainMemoryStatAvailableBytesDesc    *prometheus.Desc
+	libvirtDomainMemoryStatActualBaloonBytesDesc *prometheus.Desc
+	libvirtDomainMemoryStatRssBytesDesc          *prometheus.Desc
+	libvirtDomainMemoryStatUsableBytesDesc       *prometheus.Desc
+	libvirtDomainMemoryStatDiskCachesBytesDesc   *prometheus.Desc
+	libvirtDomainMemoryStatUsedPercentDesc       *prometheus.Desc
+	libvirtDomainMemoryStatLastUpdateDesc        *prometheus.Desc
+	libvirtDomainMemoryStatPeriodDesc            *prometheus.Desc
+	libvirtDomainMemoryOverheadDesc              *prometheus.Desc
+	libvirtDomainMemoryBalloonTargetDesc         *prometheus.Desc
+
+	errorsMap map[string]struct{}
+	errorsMu  sync.Mutex
+
+	// Whether several URIs are collected, the uri label is then attached to
+	// all metrics rather than only to libvirt_up and libvirt_versions_info.
+	uriLabelOnAll bool
+
+	// The directory holding the client TLS material for remote URIs, passed
+	// to libvirt as the pkipath URI parameter. Empty leaves libvirt's default.
+	libvirtPKIPath string
+	// The URI parameters added to remote URIs with an ssh transport.
+	libvirtSSHParams = url.Values{}
+
+	// The path of the proc filesystem.
+	procFSPath = kingpin.Flag("path.procfs", "procfs mountpoint.").Default(procfs.DefaultMountPoint).String()
+	// The path of the sys filesystem.
+	sysFSPath = kingpin.Flag("path.sysfs", "sysfs mountpoint.").Default("/sys").String()
+
+	// Which labels identify a domain: its name, its UUID or both.
+	labelDomain = kingpin.Flag("label.domain", "Labels identifying a domain on every per-domain metric, one of: name (domain label with the name), uuid (domain label with the UUID), both (domain label with the name and uuid label).").Default("name").Enum("name", "uuid", "both")
+	// Which name the domain label carries: the libvirt one or the Nova display name.
+	labelDomainSource = kingpin.Flag("label.domain-source", "Name carried by the domain label, one of: libvirt-name, nova-name (the OpenStack display name, with the libvirt name in the libvirt_name label).").Default("libvirt-name").Enum("libvirt-name", "nova-name")
+
+	// Value of the host label, the hostname reported by libvirt if empty.
+	labelHostname = kingpin.Flag("label.hostname", "Value of the host label attached to libvirt_versions_info, defaults to the hostname reported by libvirt.").Default("").String()
+	// Whether the host label is attached to every metric of the exporter.
+	labelHostnameAll = kingpin.Flag("label.hostname-all", "Attach the host label to all libvirt metrics rather than only to libvirt_versions_info. Unless --label.hostname is set, startup fails when libvirt can't tell its hostname.").Default("false").Bool()
+
+	// Maximum length of a label value, longer values are truncated.
+	labelMaxLength = kingpin.Flag("label.max-length", "Maximum length of a label value, longer values such as source files or flavor names are truncated to end with an ellipsis and the 8 hex digit FNV-1a hash of the full value, which keeps them distinct. 0 disables the limit.").Default("256").Int()
+
+	// Whether the block device meta metric carries source_file, serial and wwn.
+	labelBlockSource = kingpin.Flag("label.block-source", "Label the block device metadata with the source file, serial and WWN of the device, disable to reduce cardinality.").Default("true").Bool()
+
+	// Whether per-second rates are derived from the counters of the previous scrape.
+	metricsRates = kingpin.Flag("metrics.rates", "Export block IOPS and throughput and interface bandwidth gauges computed from the counters of the previous scrape.").Default("false").Bool()
+	// Whether the vcpu steal ratio is derived from the time and delay of the
+	// previous scrape.
+	metricsVcpuStealRatio = kingpin.Flag("metrics.vcpu-steal-ratio", "Export libvirt_domain_vcpu_steal_ratio, the share of the vcpu delay in its time and delay since the previous scrape.").Default("false").Bool()
+	// Whether the block latency is derived from the request counters of the
+	// previous scrape.
+	metricsBlockLatency = kingpin.Flag("metrics.block-latency", "Export the average latency of the block requests completed since the previous scrape.").Default("false").Bool()
+	// Whether the domain state is also exported as one boolean series per state.
+	metricsStateSeries = kingpin.Flag("metrics.state-series", "Export the domain state as one libvirt_domain_state series per state, set to 1 for the current one.").Default("false").Bool()
+	// Prefix of the metric names, to tell them from those of other libvirt tooling.
+	metricsNamespace = kingpin.Flag("metrics.namespace", "Namespace the metric names are prefixed with, libvirt_up becomes <namespace>_up.").Default("libvirt").String()
+	// Whether counters are typed as gauges, for consumers mishandling their
+	// resets when a domain restarts or migrates.
+	metricsCountersAsGauge = kingpin.Flag("metrics.counters-as-gauge", "Export the block, interface, CPU and other libvirt counters as gauges, leaving the handling of their resets to the consumer.").Default("false").Bool()
+
+	// Name of the only domain to collect, all domains are collected if empty.
+	collectDomain = kingpin.Flag("collect.domain", "Collect only the domain with this name, for debugging a single domain.").Default("").String()
+	// UUIDs of the only domains to collect, all domains are collected if empty.
+	collectDomainUUIDs = kingpin.Flag("collect.domain-uuid", "UUID of a domain to collect, libvirt then only gathers the stats of the given domains. Repeatable, unknown UUIDs are skipped with a warning.").Strings()
+
+	// UUID of the only OpenStack project whose domains are collected, all
+	// domains are collected if empty.
+	collectProjectUUID = kingpin.Flag("collect.project-uuid", "Collect only the domains of the OpenStack project with this UUID, read from the Nova metadata.").Default("").String()
+
+	// Namespaces of the metadata Nova sets on its domains, tried in order.
+	metadataNovaNamespaces = kingpin.Flag("metadata.nova.namespace", "Namespace URI of the Nova metadata of the domains, as declared by xmlns:nova in their XML. Repeatable, the namespaces are tried in order.").Default("http://openstack.org/xmlns/libvirt/nova/1.1", "http://openstack.org/xmlns/libvirt/nova/1.0").Strings()
+
+	// Whether shut off domains are collected along with the running ones.
+	collectIncludeShutoff = kingpin.Flag("collect.include-shutoff", "Collect metrics of shut off domains.").Default("true").Bool()
+	// Enabled collectors, only the stats groups they need are requested from libvirt.
+	collectVcpu      = kingpin.Flag("collect.vcpu", "Collect vcpu metrics.").Default("true").Bool()
+	collectBlock     = kingpin.Flag("collect.block", "Collect block device metrics.").Default("true").Bool()
+	collectInterface = kingpin.Flag("collect.interface", "Collect network interface metrics.").Default("true").Bool()
+	collectMemory    = kingpin.Flag("collect.memory", "Collect memory and balloon metrics.").Default("true").Bool()
+	// Whether the counters of the host tap devices are read from sysfs, as a
+	// cross-check of the interface stats reported by libvirt.
+	collectInterfaceHost = kingpin.Flag("collect.interface-host", "Collect the counters of the host tap device of every network interface from sysfs.").Default("false").Bool()
+	// Whether the queue of the host block devices backing the disks is read
+	// from sysfs.
+	collectBlockHost = kingpin.Flag("collect.block-host", "Collect the in flight I/Os and I/O time of the host block device backing every file or block device disk from sysfs.").Default("false").Bool()
+	// Whether the capacity of disks lacking it in the domain stats is looked
+	// up in the storage pools, extra libvirt calls per such disk.
+	collectBlockVolumeCapacity = kingpin.Flag("collect.block-volume-capacity", "Look up the capacity of network and pool volume disks in the libvirt storage pools when the domain stats lack it.").Default("false").Bool()
+	// Whether stats of domains busy with another job are skipped instead of waited for.
+	collectNoWait = kingpin.Flag("collect.nowait", "Don't wait for domains busy with another job, some domains may report incomplete stats then.").Default("false").Bool()
+	// Whether the snapshots of every domain are counted, an extra libvirt call per domain.
+	collectSnapshots = kingpin.Flag("collect.snapshots", "Collect the number of snapshots per domain.").Default("false").Bool()
+	// Whether the persistent definition of every domain is hashed, an extra
+	// libvirt call per domain.
+	collectConfigHash = kingpin.Flag("collect.config-hash", "Collect a hash of the persistent definition of every domain, to detect configuration drift.").Default("false").Bool()
+	// Whether lifecycle events are received from libvirt between scrapes.
+	collectLifecycleEvents = kingpin.Flag("collect.lifecycle-events", "Collect the time of the last lifecycle event of every domain, received from libvirt as they happen.").Default("false").Bool()
+	// Whether emulator and iothread pinning and NUMA placement are collected,
+	// one series per pinned CPU or NUMA node.
+	collectPinning = kingpin.Flag("collect.pinning", "Collect emulator and iothread CPU pinning and NUMA placement metrics.").Default("false").Bool()
+	// Comma separated perf events to collect, parsed into collectPerfEvents.
+	collectPerf = kingpin.Flag("collect.perf", "Comma separated list of the perf events to collect, such as cpu_cycles,instructions,cache_misses. The events must be enabled on the domains too.").Default("").String()
+	// Whether the guest agent of every domain is pinged, at most once per
+	// interval as a hung agent takes the whole timeout to answer.
+	collectGuestAgent         = kingpin.Flag("collect.guest-agent", "Collect whether the guest agent of every domain answers a guest-ping.").Default("false").Bool()
+	collectGuestAgentInterval = kingpin.Flag("collect.guest-agent-interval", "Minimum interval between two guest-pings of the guest agent of a domain, the result of the last one is reported in between.").Default("1m").Duration()
+	// Whether the vcpu time is broken down per host CPU, an extra libvirt call
+	// per domain and one series per host CPU.
+	collectVcpuCPUTime = kingpin.Flag("collect.vcpu-cpu-time", "Collect the CPU time of the vcpus of every domain per host CPU.").Default("false").Bool()
+	// Whether the storage pools are refreshed before being collected, which
+	// can be slow on network pools.
+	collectPoolRefresh = kingpin.Flag("collect.pool-refresh", "Refresh the storage pools before collecting them, disable to report the figures of their last refresh.").Default("true").Bool()
+	// Whether the PCI and mediated devices of the host are collected.
+	collectNodeDevices = kingpin.Flag("collect.node-devices", "Collect the PCI and mediated devices of the host, and how many more mediated devices such as vGPUs can be created.").Default("false").Bool()
+	// How long a domain may be shutting down or suspended before it is
+	// reported as stuck.
+	collectTransientStateThreshold = kingpin.Flag("collect.transient-state-threshold", "Time after which a domain still shutting down or suspended by guest power management is reported in libvirt_domain_in_transient_state.").Default("5m").Duration()
+	// Maximum number of domains collected per scrape, 0 for no limit. The
+	// domains are collected in turns over the scrapes.
+	collectMaxDomains = kingpin.Flag("collect.max-domains", "Maximum number of domains collected per scrape, the next ones are collected by the following scrapes. 0 collects all domains.").Default("0").Int()
+
+	collectPerfEvents []string
+)
+
+// perfEventValue returns the count of a perf event, as libvirt names it, from
+// the perf stats of a domain. Only the counting events are known, not the
+// cmt, mbmt and mbml gauges.
+func perfEventValue(perf *libvirt.DomainStatsPerf, event string) (value uint64, set bool, known bool) {
+	switch event {
+	case "cache_misses":
+		return perf.CacheMisses, perf.CacheMissesSet, true
+	case "cache_references":
+		return perf.CacheReferences, perf.CacheReferencesSet, true
+	case "instructions":
+		return perf.Instructions, perf.InstructionsSet, true
+	case "cpu_cycles":
+		return perf.CpuCycles, perf.CpuCyclesSet, true
+	case "branch_instructions":
+		return perf.BranchInstructions, perf.BranchInstructionsSet, true
+	case "branch_misses":
+		return perf.BranchMisses, perf.BranchMissesSet, true
+	case "bus_cycles":
+		return perf.BusCycles, perf.BusCyclesSet, true
+	case "stalled_cycles_frontend":
+		return perf.StalledCyclesFrontend, perf.StalledCyclesFrontendSet, true
+	case "stalled_cycles_backend":
+		return perf.StalledCyclesBackend, perf.StalledCyclesBackendSet, true
+	case "ref_cpu_cycles":
+		return perf.RefCpuCycles, perf.RefCpuCyclesSet, true
+	case "cpu_clock":
+		return perf.CpuClock, perf.CpuClockSet, true
+	case "task_clock":
+		return perf.TaskClock, perf.TaskClockSet, true
+	case "page_faults":
+		return perf.PageFaults, perf.PageFaultsSet, true
+	case "context_switches":
+		return perf.ContextSwitches, perf.ContextSwitchesSet, true
+	case "cpu_migrations":
+		return perf.CpuMigrations, perf.CpuMigrationsSet, true
+	case "page_faults_min":
+		return perf.PageFaultsMin, perf.PageFaultsMinSet, true
+	case "page_faults_maj":
+		return perf.PageFaultsMaj, perf.PageFaultsMajSet, true
+	case "alignment_faults":
+		return perf.AlignmentFaults, perf.AlignmentFaultsSet, true
+	case "emulation_faults":
+		return perf.EmulationFaults, perf.EmulationFaultsSet, true
+	}
+	return 0, false, false
+}
+
+// parsePerfEvents parses the comma separated perf events of --collect.perf.
+func parsePerfEvents(list string) ([]string, error) {
+	var events []string
+	for _, event := range strings.Split(list, ",") {
+		event = strings.TrimSpace(event)
+		if event == "" {
+			continue
+		}
+		if _, _, known := perfEventValue(&libvirt.DomainStatsPerf{}, event); !known {
+			return nil, fmt.Errorf("unknown perf event %q", event)
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// domainLabelNames returns the names of the labels identifying a domain,
+// followed by the given label names.
+func domainLabelNames(labels ...string) []string {
+	names := []string{"domain"}
+	if *labelDomain == "both" {
+		names = append(names, "uuid")
+	}
+	if *labelDomain != "uuid" && *labelDomainSource == "nova-name" {
+		names = append(names, "libvirt_name")
+	}
+	return append(names, labels...)
+}
+
+// domainLabelValues returns the values of the labels identifying a domain,
+// matching the names returned by domainLabelNames. The Nova display name
+// replaces the libvirt name with --label.domain-source=nova-name, unless the
+// domain has none.
+func domainLabelValues(name, novaName, uuid string) []string {
+	if *labelDomain == "uuid" {
+		return []string{uuid}
+	}
+	displayName := name
+	if *labelDomainSource == "nova-name" && novaName != "" {
+		displayName = novaName
+	}
+	values := []string{displayName}
+	if *labelDomain == "both" {
+		values = append(values, uuid)
+	}
+	if *labelDomainSource == "nova-name" {
+		values = append(values, name)
+	}
+	return values
+}
+
+// domainMetaLabelNames returns the given label names for the domain meta
+// metric, preceded by uuid unless the domain is already labelled with it.
+func domainMetaLabelNames(labels ...string) []string {
+	if *labelDomain == "both" {
+		return labels
+	}
+	return append([]string{"uuid"}, labels...)
+}
+
+// domainMetaLabelValues returns the given label values for the domain meta
+// metric, matching the names returned by domainMetaLabelNames.
+func domainMetaLabelValues(uuid string, values ...string) []string {
+	if *labelDomain == "both" {
+		return values
+	}
+	return append([]string{uuid}, values...)
+}
+
+// versionsInfoLabelNames returns the label names of libvirt_versions_info. It
+// carries the host label itself unless the label is attached to all metrics
+// at registration.
+func versionsInfoLabelNames() []string {
+	labels := []string{"hypervisor_running", "libvirtd_running", "libvirt_library"}
+	if !*labelHostnameAll {
+		labels = append(labels, "host")
+	}
+	return append(labels, uriLabelNames()...)
+}
+
+// uriLabelNames returns the uri label name for libvirt_up and
+// libvirt_versions_info, unless the label is attached to all metrics.
+func uriLabelNames() []string {
+	if uriLabelOnAll {
+		return nil
+	}
+	return []string{"uri"}
+}
+
+// uriLabelValues returns the value matching uriLabelNames.
+func uriLabelValues(uri string) []string {
+	if uriLabelOnAll {
+		return nil
+	}
+	return []string{uri}
+}
+
+// hostLabelValue returns the value of the host label: --label.hostname if
+// set, the hostname reported by libvirt otherwise.
+func hostLabelValue(conn *libvirt.Connect) (string, error) {
+	if *labelHostname != "" {
+		return *labelHostname, nil
+	}
+	return conn.GetHostname()
+}
+
+// scrapeHostLabel returns the host label of libvirt_versions_info. The
+// hostname reported by libvirt is asked for once per URI, until then
+// a failure falls back to the host of uri rather than failing the scrape.
+func scrapeHostLabel(conn *libvirt.Connect, uri string, samples *sampleStores, logger log.Logger) string {
+	if host, _, ok := samples.hostnames.get(uri); ok {
+		return host
+	}
+	host, err := hostLabelValue(conn)
+	if err != nil {
+		WriteErrorOnce("Unable to get the hostname, the host label falls back to the host of the URI: "+err.Error(), "hostname_"+uri, logger)
+		if u, err := url.Parse(uri); err == nil {
+			return u.Hostname()
+		}
+		return ""
+	}
+	samples.hostnames.set(uri, host)
+	return host
+}
+
+// hostLabelAttempts is the number of attempts to resolve the host label at
+// startup before giving up.
+const hostLabelAttempts = 3
+
+// resolveHostLabel returns the host label of the exporter of uri, which has
+// to be known before the exporter is registered. Unless --label.hostname is
+// set, libvirt is asked for it, retrying with the reconnect backoff while
+// libvirt is unavailable, e.g. still starting at boot.
+func resolveHostLabel(uri string, timeout time.Duration, logger log.Logger) (string, error) {
+	if *labelHostname != "" {
+		return *labelHostname, nil
+	}
+	backoff := minReconnectBackoff
+	for attempt := 1; ; attempt++ {
+		conn, err := connectWithTimeout(uri, timeout)
+		if err == nil {
+			var host string
+			host, err = hostLabelValue(conn)
+			_, _ = conn.Close()
+			if err == nil {
+				return host, nil
+			}
+		}
+		if attempt == hostLabelAttempts {
+			return "", fmt.Errorf("unable to resolve the host label of %s after %d attempts, set --label.hostname: %w", uri, attempt, err)
+		}
+		_ = level.Warn(logger).Log("msg", "failed to resolve the host label, retrying", "uri", uri, "retry_in", backoff, "err", err)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, maxReconnectBackoff)
+	}
+}
+
+// blockMetaLabelNames returns the label names of the block device meta
+// metric, following the domain labels.
+func blockMetaLabelNames() []string {
+	return blockMetaLabelValues("target_device", "source_file", "serial", "wwn", "bus", "disk_type", "driver_type", "cache", "discard", "readonly")
+}
+
+// blockMetaLabelValues returns the given block device meta label values,
+// without source_file, serial and wwn unless --label.block-source is set.
+func blockMetaLabelValues(target, source, serial, wwn, bus, diskType, driverType, cache, discard, readOnly string) []string {
+	if *labelBlockSource {
+		return []string{target, source, serial, wwn, bus, diskType, driverType, cache, discard, readOnly}
+	}
+	return []string{target, bus, diskType, driverType, cache, discard, readOnly}
+}
+
+// initDescs creates the metric descriptors and the API call metrics under
+// namespace. It runs once the command line is parsed, as the labels
+// identifying a domain depend on --label.domain.
+func initDescs(namespace string) {
+	libvirtUpName = prometheus.BuildFQName(namespace, "", "up")
+	libvirtAPICallDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "api",
+		Name:      "call_duration_seconds",
+		Help:      "Duration of the libvirt API calls made by the exporter.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+	}, []string{"call"})
+	libvirtAPICalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "api",
+		Name:      "calls_total",
+		Help:      "Number of libvirt API calls made by the exporter, by result.",
+	}, []string{"call", "result"})
+
 	libvirtUpDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "", "up"),
+		prometheus.BuildFQName(namespace, "", "up"),
 		"Whether scraping libvirt's metrics was successful.",
+		uriLabelNames(),
+		nil)
+	libvirtUpErrorDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "up_error"),
+		"Why scraping libvirt's metrics failed, one series per reason with the failing one set to 1. "+
+			"connect: libvirt couldn't be reached, auth: the connection was refused, "+
+			"version: the versions couldn't be read, stats: collecting the domains or pools failed.",
+		append(uriLabelNames(), "reason"),
+		nil)
+	libvirtLastScrapeSuccessDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "last_scrape_success_timestamp_seconds"),
+		"Unix time of the last successful scrape of libvirt's metrics.",
+		uriLabelNames(),
+		nil)
+	libvirtCacheHitDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "cache", "hit"),
+		"Whether the metrics were served from the cache instead of scraping libvirt.",
+		nil,
+		nil)
+	libvirtCacheAgeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "cache", "age_seconds"),
+		"Age of the served metrics, in seconds. 0 when libvirt was just scraped.",
 		nil,
 		nil)
+	libvirtCollectCursorDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "collect", "cursor"),
+		"Position, in the domains ordered by UUID, of the first domain collected by this scrape when --collect.max-domains is set.",
+		uriLabelNames(),
+		nil)
 	libvirtPoolInfoCapacity = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "pool_info", "capacity_bytes"),
+		prometheus.BuildFQName(namespace, "pool_info", "capacity_bytes"),
 		"Pool capacity, in bytes",
 		[]string{"pool"},
 		nil)
 	libvirtPoolInfoAllocation = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "pool_info", "allocation_bytes"),
+		prometheus.BuildFQName(namespace, "pool_info", "allocation_bytes"),
 		"Pool allocation, in bytes",
 		[]string{"pool"},
 		nil)
 	libvirtPoolInfoAvailable = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "pool_info", "available_bytes"),
+		prometheus.BuildFQName(namespace, "pool_info", "available_bytes"),
 		"Pool available, in bytes",
 		[]string{"pool"},
 		nil)
+	libvirtPoolInfoUsedRatio = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "pool_info", "used_ratio"),
+		"Pool allocation relative to its capacity, from 0 to 1",
+		[]string{"pool"},
+		nil)
+	libvirtPoolInfoAutostart = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "pool_info", "autostart"),
+		"Whether the pool is started automatically when the host boots. 1: autostart, 0: manual",
+		[]string{"pool"},
+		nil)
+	libvirtPoolInfoPersistent = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "pool_info", "persistent"),
+		"Whether the pool has a persistent configuration. 1: persistent, 0: transient",
+		[]string{"pool"},
+		nil)
+	libvirtPoolRefreshDuration = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "pool", "refresh_duration_seconds"),
+		"Time the last refresh of the pool took, in seconds.",
+		[]string{"pool"},
+		nil)
+	libvirtPoolRefreshErrors = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "pool", "refresh_errors_total"),
+		"Number of refreshes of the pool which failed.",
+		[]string{"pool"},
+		nil)
+	libvirtNodeDeviceInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "node_device", "info"),
+		"PCI and mediated devices of the host, with the driver bound to them. type: pci or mdev",
+		[]string{"name", "driver", "type"},
+		nil)
+	libvirtNodeDeviceMdevAvailableDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "node_device", "mdev_available_instances"),
+		"Number of mediated devices of the type the PCI device can still create, e.g. vGPUs.",
+		[]string{"name", "mdev_type"},
+		nil)
 	libvirtVersionsInfoDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "", "versions_info"),
+		prometheus.BuildFQName(namespace, "", "versions_info"),
 		"Versions of virtualization components",
-		[]string{"hypervisor_running", "libvirtd_running", "libvirt_library"},
+		versionsInfoLabelNames(),
 		nil)
 	libvirtDomainInfoMetaDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_info", "meta"),
+		prometheus.BuildFQName(namespace, "domain_info", "meta"),
 		"Domain metadata",
-		[]string{"domain", "uuid", "instance_name", "flavor", "user_name", "user_uuid", "project_name", "project_uuid", "root_type", "root_uuid"},
+		domainLabelNames(domainMetaLabelNames("instance_name", "flavor", "user_name", "user_uuid", "project_name", "project_uuid", "root_type", "root_uuid")...),
 		nil)
 	libvirtDomainInfoMaxMemBytesDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_info", "maximum_memory_bytes"),
+		prometheus.BuildFQName(namespace, "domain_info", "maximum_memory_bytes"),
 		"Maximum allowed memory of the domain, in bytes.",
-		[]string{"domain"},
+		domainLabelNames(),
 		nil)
 	libvirtDomainInfoMemoryUsageBytesDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_info", "memory_usage_bytes"),
+		prometheus.BuildFQName(namespace, "domain_info", "memory_usage_bytes"),
 		"Memory usage of the domain, in bytes.",
-		[]string{"domain"},
+		domainLabelNames(),
 		nil)
 	libvirtDomainInfoNrVirtCPUDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_info", "virtual_cpus"),
+		prometheus.BuildFQName(namespace, "domain_info", "virtual_cpus"),
 		"Number of virtual CPUs for the domain.",
-		[]string{"domain"},
+		domainLabelNames(),
+		nil)
+	libvirtDomainInfoVcpuMaxDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_info", "vcpu_max"),
+		"Maximum number of virtual CPUs for the domain, the limit of virtual_cpus for vcpu hotplug.",
+		domainLabelNames(),
 		nil)
 	libvirtDomainInfoCPUTimeDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_info", "cpu_time_seconds_total"),
+		prometheus.BuildFQName(namespace, "domain_info", "cpu_time_seconds_total"),
 		"Amount of CPU time used by the domain, in seconds.",
-		[]string{"domain"},
+		domainLabelNames(),
 		nil)
 	libvirtDomainInfoVirDomainState = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_info", "vstate"),
+		prometheus.BuildFQName(namespace, "domain_info", "vstate"),
 		"Virtual domain state. 0: no state, 1: the domain is running, 2: the domain is blocked on resource,"+
 			" 3: the domain is paused by user, 4: the domain is being shut down, 5: the domain is shut off,"+
 			"6: the domain is crashed, 7: the domain is suspended by guest power management",
-		[]string{"domain"},
+		domainLabelNames(),
+		nil)
+	libvirtDomainStateDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "state"),
+		"Whether the domain is in the state, one series per state with the current one set to 1.",
+		domainLabelNames("state"),
+		nil)
+	libvirtDomainInTransientStateDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "in_transient_state"),
+		"Whether the domain has been shutting down or suspended by guest power management for longer than --collect.transient-state-threshold.",
+		domainLabelNames(),
+		nil)
+	libvirtDomainInfoStateReasonDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_info", "state_reason"),
+		"Reason the domain is in its current state, to be read together with vstate. "+
+			"Running: 1 booted, 2 migrated, 3 restored, 4 from snapshot, 5 unpaused, 6 migration canceled, 7 save canceled, 8 woken up, 9 crashed, 10 post-copy. "+
+			"Paused: 1 by user, 2 migration, 3 save, 4 dump, 5 I/O error, 6 watchdog, 7 from snapshot, 8 shutting down, 9 snapshot, 10 crashed, 11 starting up, 12 post-copy, 13 post-copy failed, 14 API error. "+
+			"Shutdown: 1 by user. "+
+			"Shutoff: 1 shutdown, 2 destroyed, 3 crashed, 4 migrated, 5 saved, 6 failed, 7 from snapshot, 8 daemon. "+
+			"Crashed: 1 panicked. "+
+			"0 is an unknown reason for every state.",
+		domainLabelNames(),
+		nil)
+	libvirtDomainTPMPresentDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "tpm_present"),
+		"Whether the domain has a TPM device configured. 1: present, 0: absent",
+		domainLabelNames(),
+		nil)
+	libvirtDomainSecureBootEnabledDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "secureboot_enabled"),
+		"Whether the domain firmware is configured with secure boot. 1: enabled, 0: disabled",
+		domainLabelNames(),
+		nil)
+	libvirtDomainWatchdogPresentDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "watchdog_present"),
+		"Whether the domain has a watchdog device, labelled with its action. 1: present, 0: absent",
+		domainLabelNames("action"),
+		nil)
+	libvirtDomainRNGPresentDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "rng_present"),
+		"Whether the domain has a random number generator device, labelled with its backend. 1: present, 0: absent",
+		domainLabelNames("backend"),
+		nil)
+	libvirtDomainControllerInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "controller_info"),
+		"Controllers of the domain. Type, index, model.",
+		domainLabelNames("type", "index", "model"),
+		nil)
+	libvirtDomainPeripheralInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "peripheral_info"),
+		"Sound, input and USB redirection devices of the domain. Device, type, bus, model.",
+		domainLabelNames("device", "type", "bus", "model"),
+		nil)
+	libvirtDomainHostdevInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "hostdev_info"),
+		"Host devices passed through to the domain. Type, host address of the device.",
+		domainLabelNames("type", "address"),
+		nil)
+	libvirtDomainFilesystemInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "filesystem_info"),
+		"Host directories shared with the domain. Source directory, target mount tag, driver.",
+		domainLabelNames("source_dir", "target_dir", "driver"),
+		nil)
+	libvirtDomainChannelInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "channel_info"),
+		"Channel and console devices of the domain. Device, host side type, target name of a channel or target type of a console, connection state of a channel.",
+		domainLabelNames("device", "type", "target_name", "state"),
+		nil)
+	libvirtDomainGuestAgentConnectedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "guest_agent_connected"),
+		"Whether the guest agent of the domain answered the last guest-ping, 1 if it did, 0 otherwise.",
+		domainLabelNames(),
+		nil)
+	libvirtDomainVsockInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "vsock_info"),
+		"Vsock device of the domain. Context ID of the guest, empty until one is assigned automatically.",
+		domainLabelNames("cid"),
+		nil)
+	libvirtDomainHyperVFeatureDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "hyperv_feature"),
+		"Hyper-V enlightenments enabled for the domain, one series per feature.",
+		domainLabelNames("feature"),
+		nil)
+	libvirtDomainPerfEventsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "perf_events_total"),
+		"Count of the perf event, as selected with --collect.perf and enabled on the domain.",
+		domainLabelNames("event"),
+		nil)
+	libvirtDomainBootOrderDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "boot_order"),
+		"Boot order of a device of the domain, 1 boots first. Disks are named by target device, interfaces by target device or MAC address.",
+		domainLabelNames("device"),
+		nil)
+	libvirtDomainSnapshotsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "snapshots"),
+		"Number of snapshots of the domain.",
+		domainLabelNames(),
+		nil)
+	libvirtDomainGraphicsInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "graphics_info"),
+		"Graphics devices of the domain. Type, port and listen address.",
+		domainLabelNames("type", "port", "listen"),
+		nil)
+	libvirtDomainVideoInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "video_info"),
+		"Video devices of the domain. Model type.",
+		domainLabelNames("model"),
+		nil)
+	libvirtDomainOSInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "os_info"),
+		"Guest OS of the domain. Architecture, machine type, OS type.",
+		domainLabelNames("arch", "machine", "os_type"),
+		nil)
+	libvirtDomainCPUInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "cpu_info"),
+		"CPU presented to the guest of the domain. CPU mode, model.",
+		domainLabelNames("mode", "model"),
+		nil)
+	libvirtDomainCPUTopologyDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "cpu_topology"),
+		"CPU topology presented to the guest of the domain, when set in the domain XML. Sockets, cores per socket, threads per core.",
+		domainLabelNames("sockets", "cores", "threads"),
+		nil)
+	libvirtDomainConfigHashDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "config_hash"),
+		"FNV-1a hash of the persistent XML definition of the domain, changes whenever the definition does.",
+		domainLabelNames(),
+		nil)
+	libvirtDomainSecLabelInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "seclabel_info"),
+		"Security labels of the domain. Model, type, whether resources are relabeled.",
+		domainLabelNames("model", "type", "relabel"),
+		nil)
+	libvirtDomainMemoryBackingInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "memory_backing_info"),
+		"Memory backing of the domain. Source type, whether hugepages are used.",
+		domainLabelNames("source_type", "hugepages"),
+		nil)
+	libvirtDomainMemoryHugepageBackedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_memory_stats", "hugepage_backed_bytes"),
+		"Memory of the domain backed by hugepages, the guest NUMA cells of their nodesets or all of it, in bytes.",
+		domainLabelNames(),
+		nil)
+	libvirtDomainLifecycleEventDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "last_lifecycle_event_timestamp_seconds"),
+		"Time of the last lifecycle event of the domain received from libvirt, in seconds since epoch.",
+		domainLabelNames("event"),
+		nil)
+	libvirtDomainProcessResidentMemDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_process", "resident_memory_bytes"),
+		"Resident memory of the QEMU process running the domain on the host, in bytes.",
+		domainLabelNames(),
+		nil)
+	libvirtDomainProcessCPUSecondsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_process", "cpu_seconds_total"),
+		"User and system CPU time spent by the QEMU process running the domain on the host, in seconds.",
+		domainLabelNames(),
+		nil)
+	libvirtDomainProcessOpenFDsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_process", "open_fds"),
+		"Number of file descriptors open by the QEMU process running the domain.",
+		domainLabelNames(),
+		nil)
+	libvirtDomainProcessMaxFDsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_process", "max_fds"),
+		"Limit on the file descriptors the QEMU process running the domain can open.",
+		domainLabelNames(),
+		nil)
+	libvirtDomainScrapeDurationDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "scrape_duration_seconds"),
+		"Time spent collecting the metrics of the domain, in seconds.",
+		domainLabelNames(),
 		nil)
 
 	libvirtDomainVcpuTimeDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_vcpu", "time_seconds_total"),
+		prometheus.BuildFQName(namespace, "domain_vcpu", "time_seconds_total"),
 		"Amount of CPU time used by the domain's VCPU, in seconds.",
-		[]string{"domain", "vcpu"},
+		domainLabelNames("vcpu"),
 		nil)
 	libvirtDomainVcpuDelayDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_vcpu", "delay_seconds_total"),
+		prometheus.BuildFQName(namespace, "domain_vcpu", "delay_seconds_total"),
 		"Amount of CPU time used by the domain's VCPU, in seconds. "+
 			"Vcpu's delay metric. Time the vcpu thread was enqueued by the "+
 			"host scheduler, but was waiting in the queue instead of running. "+
 			"Exposed to the VM as a steal time.",
-		[]string{"domain", "vcpu"},
+		domainLabelNames("vcpu"),
 		nil)
 	libvirtDomainVcpuStateDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_vcpu", "state"),
+		prometheus.BuildFQName(namespace, "domain_vcpu", "state"),
 		"VCPU state. 0: offline, 1: running, 2: blocked",
-		[]string{"domain", "vcpu"},
+		domainLabelNames("vcpu"),
 		nil)
 	libvirtDomainVcpuCPUDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_vcpu", "cpu"),
+		prometheus.BuildFQName(namespace, "domain_vcpu", "cpu"),
 		"Real CPU number, or one of the values from virVcpuHostCpuState",
-		[]string{"domain", "vcpu"},
+		domainLabelNames("vcpu"),
+		nil)
+	libvirtDomainVcpuCPUTimeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_vcpu", "cpu_time_seconds_total"),
+		"Amount of CPU time used by all the domain's VCPUs on a host CPU, in seconds.",
+		domainLabelNames("cpu"),
 		nil)
 	libvirtDomainVcpuWaitDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_vcpu", "wait_seconds_total"),
+		prometheus.BuildFQName(namespace, "domain_vcpu", "wait_seconds_total"),
 		"Vcpu's wait_sum metric. CONFIG_SCHEDSTATS has to be enabled",
-		[]string{"domain", "vcpu"},
+		domainLabelNames("vcpu"),
+		nil)
+	libvirtDomainVcpuStealDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_vcpu", "steal_ratio"),
+		"Share of the time the vcpu was running or waiting to run that it spent waiting, since the previous scrape.",
+		domainLabelNames("vcpu"),
+		nil)
+
+	libvirtDomainEmulatorPinDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "emulator_pin"),
+		"Host CPU the domain's emulator threads are allowed to run on.",
+		domainLabelNames("cpu"),
+		nil)
+	libvirtDomainIOThreadPinDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "iothread_pin"),
+		"Host CPU the domain's iothread is allowed to run on.",
+		domainLabelNames("iothread", "cpu"),
+		nil)
+	libvirtDomainNumatuneModeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "numatune_mode"),
+		"NUMA memory allocation mode of the domain. 0: strict, 1: preferred, 2: interleave, 3: restrictive",
+		domainLabelNames(),
+		nil)
+	libvirtDomainNumatuneNodesetDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "numatune_nodeset"),
+		"Host NUMA node the domain's memory is allocated from.",
+		domainLabelNames("node"),
 		nil)
 
+	libvirtDomainBlockHWInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block", "hw_info"),
+		"Hardware properties a block device advertises to the guest, empty when left to the hypervisor. "+
+			"Rotation rate (1 for a non-rotational disk), logical and physical block size, discard granularity.",
+		domainLabelNames("target_device", "rotation_rate", "logical_block_size", "physical_block_size", "discard_granularity"),
+		nil)
+	libvirtDomainBlockQueuesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block", "queues"),
+		"Number of queues configured on the driver of a block device.",
+		domainLabelNames("target_device"),
+		nil)
+	libvirtDomainBlockIOThreadDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block", "iothread"),
+		"IOThreads a block device is assigned to in the domain XML.",
+		domainLabelNames("target_device", "iothread"),
+		nil)
+	libvirtDomainBlockHostIOInflightDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block", "host_io_inflight"),
+		"Number of I/Os in flight on the host block device backing a block device, shared with whatever else uses the host device.",
+		domainLabelNames("target_device"),
+		nil)
+	libvirtDomainBlockHostIOTimeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block", "host_io_time_seconds_total"),
+		"Time the host block device backing a block device spent doing I/Os.",
+		domainLabelNames("target_device"),
+		nil)
+	libvirtDomainBlockHostIOTimeWeightedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block", "host_io_time_weighted_seconds_total"),
+		"Time spent by all the I/Os on the host block device backing a block device, the rate of which is the average queue depth.",
+		domainLabelNames("target_device"),
+		nil)
 	libvirtDomainMetaBlockDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block", "meta"),
-		"Block device metadata info. Device name, source file, serial.",
-		[]string{"domain", "target_device", "source_file", "serial", "bus", "disk_type", "driver_type", "cache", "discard"},
+		prometheus.BuildFQName(namespace, "domain_block", "meta"),
+		"Block device metadata info. Device name, source file, serial, WWN of the LUN shared by multipath members.",
+		domainLabelNames(blockMetaLabelNames()...),
 		nil)
 	libvirtDomainBlockRdBytesDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "read_bytes_total"),
+		prometheus.BuildFQName(namespace, "domain_block_stats", "read_bytes_total"),
 		"Number of bytes read from a block device, in bytes.",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
 		nil)
 	libvirtDomainBlockRdReqDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "read_requests_total"),
+		prometheus.BuildFQName(namespace, "domain_block_stats", "read_requests_total"),
 		"Number of read requests from a block device.",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
 		nil)
 	libvirtDomainBlockRdTotalTimeSecondsDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "read_time_seconds_total"),
+		prometheus.BuildFQName(namespace, "domain_block_stats", "read_time_seconds_total"),
 		"Total time spent on reads from a block device, in seconds.",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
 		nil)
 	libvirtDomainBlockWrBytesDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "write_bytes_total"),
+		prometheus.BuildFQName(namespace, "domain_block_stats", "write_bytes_total"),
 		"Number of bytes written to a block device, in bytes.",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
 		nil)
 	libvirtDomainBlockWrReqDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "write_requests_total"),
+		prometheus.BuildFQName(namespace, "domain_block_stats", "write_requests_total"),
 		"Number of write requests to a block device.",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
 		nil)
 	libvirtDomainBlockWrTotalTimesDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "write_time_seconds_total"),
+		prometheus.BuildFQName(namespace, "domain_block_stats", "write_time_seconds_total"),
 		"Total time spent on writes on a block device, in seconds",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
+		nil)
+	libvirtDomainBlockRdLatencySecondsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block_stats", "read_latency_seconds"),
+		"Average latency of the reads from a block device completed since the previous scrape, in seconds.",
+		domainLabelNames("target_device"),
+		nil)
+	libvirtDomainBlockWrLatencySecondsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block_stats", "write_latency_seconds"),
+		"Average latency of the writes on a block device completed since the previous scrape, in seconds.",
+		domainLabelNames("target_device"),
+		nil)
+	libvirtDomainBlockRdIopsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block_stats", "read_iops"),
+		"Read requests per second to a block device since the previous scrape.",
+		domainLabelNames("target_device"),
+		nil)
+	libvirtDomainBlockWrIopsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block_stats", "write_iops"),
+		"Write requests per second to a block device since the previous scrape.",
+		domainLabelNames("target_device"),
+		nil)
+	libvirtDomainBlockRdBytesPerSecondDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block_stats", "read_bytes_per_second"),
+		"Bytes read per second from a block device since the previous scrape.",
+		domainLabelNames("target_device"),
+		nil)
+	libvirtDomainBlockWrBytesPerSecondDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block_stats", "write_bytes_per_second"),
+		"Bytes written per second to a block device since the previous scrape.",
+		domainLabelNames("target_device"),
 		nil)
 	libvirtDomainBlockFlushReqDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "flush_requests_total"),
+		prometheus.BuildFQName(namespace, "domain_block_stats", "flush_requests_total"),
 		"Total flush requests from a block device.",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
 		nil)
 	libvirtDomainBlockFlushTotalTimeSecondsDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "flush_time_seconds_total"),
+		prometheus.BuildFQName(namespace, "domain_block_stats", "flush_time_seconds_total"),
 		"Total time in seconds spent on cache flushing to a block device",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
 		nil)
 	libvirtDomainBlockAllocationDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "allocation"),
+		prometheus.BuildFQName(namespace, "domain_block_stats", "allocation"),
 		"Offset of the highest written sector on a block device.",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
 		nil)
 	libvirtDomainBlockCapacityBytesDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "capacity_bytes"),
+		prometheus.BuildFQName(namespace, "domain_block_stats", "capacity_bytes"),
 		"Logical size in bytes of the block device	backing image.",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
 		nil)
 	libvirtDomainBlockPhysicalSizeBytesDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "physicalsize_bytes"),
+		prometheus.BuildFQName(namespace, "domain_block_stats", "physicalsize_bytes"),
 		"Physical size in bytes of the container of the backing image.",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
+		nil)
+	libvirtDomainBlockUsedRatioDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block_stats", "used_ratio"),
+		"Ratio of the allocation to the capacity of a block device, between 0 and 1.",
+		domainLabelNames("target_device"),
 		nil)
 
 	// Block IO tune parameters
 	// Limits
 	libvirtDomainBlockTotalBytesSecDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_total_bytes"),
+		prometheus.BuildFQName(namespace, "domain_block_stats", "limit_total_bytes"),
 		"Total throughput limit in bytes per second",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
 		nil)
 	libvirtDomainBlockWriteBytesSecDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_write_bytes"),
+		prometheus.BuildFQName(namespace, "domain_block_stats", "limit_write_bytes"),
 		"Write throughput limit in bytes per second",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
 		nil)
 	libvirtDomainBlockReadBytesSecDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_read_bytes"),
+		prometheus.BuildFQName(namespace, "domain_block_stats", "limit_read_bytes"),
 		"Read throughput limit in bytes per second",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
 		nil)
 	libvirtDomainBlockTotalIopsSecDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_total_requests"),
+		prometheus.BuildFQName(namespace, "domain_block_stats", "limit_total_requests"),
 		"Total requests per second limit",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
 		nil)
 	libvirtDomainBlockWriteIopsSecDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_write_requests"),
+		prometheus.BuildFQName(namespace, "domain_block_stats", "limit_write_requests"),
 		"Write requests per second limit",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
 		nil)
 	libvirtDomainBlockReadIopsSecDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_read_requests"),
+		prometheus.BuildFQName(namespace, "domain_block_stats", "limit_read_requests"),
 		"Read requests per second limit",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
 		nil)
 	// Burst limits
 	libvirtDomainBlockTotalBytesSecMaxDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_burst_total_bytes"),
+		prometheus.BuildFQName(namespace, "domain_block_stats", "limit_burst_total_bytes"),
 		"Total throughput burst limit in bytes per second",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
 		nil)
 	libvirtDomainBlockWriteBytesSecMaxDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_burst_write_bytes"),
+		prometheus.BuildFQName(namespace, "domain_block_stats", "limit_burst_write_bytes"),
 		"Write throughput burst limit in bytes per second",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
 		nil)
 	libvirtDomainBlockReadBytesSecMaxDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_burst_read_bytes"),
+		prometheus.BuildFQName(namespace, "domain_block_stats", "limit_burst_read_bytes"),
 		"Read throughput burst limit in bytes per second",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
 		nil)
 	libvirtDomainBlockTotalIopsSecMaxDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_burst_total_requests"),
+		prometheus.BuildFQName(namespace, "domain_block_stats", "limit_burst_total_requests"),
 		"Total requests per second burst limit",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
 		nil)
 	libvirtDomainBlockWriteIopsSecMaxDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_burst_write_requests"),
+		prometheus.BuildFQName(namespace, "domain_block_stats", "limit_burst_write_requests"),
 		"Write requests per second burst limit",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
 		nil)
 	libvirtDomainBlockReadIopsSecMaxDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_burst_read_requests"),
+		prometheus.BuildFQName(namespace, "domain_block_stats", "limit_burst_read_requests"),
 		"Read requests per second burst limit",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
 		nil)
 	libvirtDomainBlockTotalBytesSecMaxLengthDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_burst_total_bytes_length_seconds"),
+		prometheus.BuildFQName(namespace, "domain_block_stats", "limit_burst_total_bytes_length_seconds"),
 		"Total throughput burst time in seconds",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
 		nil)
 	libvirtDomainBlockWriteBytesSecMaxLengthDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_burst_write_bytes_length_seconds"),
+		prometheus.BuildFQName(namespace, "domain_block_stats", "limit_burst_write_bytes_length_seconds"),
 		"Write throughput burst time in seconds",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
 		nil)
 	libvirtDomainBlockReadBytesSecMaxLengthDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_burst_read_bytes_length_seconds"),
+		prometheus.BuildFQName(namespace, "domain_block_stats", "limit_burst_read_bytes_length_seconds"),
 		"Read throughput burst time in seconds",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
 		nil)
 	libvirtDomainBlockTotalIopsSecMaxLengthDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_burst_length_total_requests_seconds"),
+		prometheus.BuildFQName(namespace, "domain_block_stats", "limit_burst_length_total_requests_seconds"),
 		"Total requests per second burst time in seconds",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
 		nil)
 	libvirtDomainBlockWriteIopsSecMaxLengthDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_burst_length_write_requests_seconds"),
+		prometheus.BuildFQName(namespace, "domain_block_stats", "limit_burst_length_write_requests_seconds"),
 		"Write requests per second burst time in seconds",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
 		nil)
 	libvirtDomainBlockReadIopsSecMaxLengthDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_burst_length_read_requests_seconds"),
+		prometheus.BuildFQName(namespace, "domain_block_stats", "limit_burst_length_read_requests_seconds"),
 		"Read requests per second burst time in seconds",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
+		nil)
+	libvirtDomainBlockIoTuneGroupDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block", "iotune_group"),
+		"Throttling group a block device shares its IO limits with.",
+		domainLabelNames("target_device", "group_name"),
+		nil)
+	libvirtDomainBlkioWeightDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_blkio", "weight"),
+		"Proportional blkio weight of the domain.",
+		domainLabelNames(),
+		nil)
+	libvirtDomainBlkioDeviceWeightDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_blkio", "device_weight"),
+		"Proportional blkio weight of the domain on a host device.",
+		domainLabelNames("path"),
 		nil)
 	libvirtDomainBlockSizeIopsSecDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "size_iops_bytes"),
+		prometheus.BuildFQName(namespace, "domain_block_stats", "size_iops_bytes"),
 		"The size of IO operations per second permitted through a block device",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
 		nil)
 
 	libvirtDomainMetaInterfacesDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_interface", "meta"),
+		prometheus.BuildFQName(namespace, "domain_interface", "meta"),
 		"Interfaces metadata. Source bridge, target device, interface uuid",
-		[]string{"domain", "source_bridge", "target_device", "virtual_interface"},
+		domainLabelNames("source_bridge", "target_device", "virtual_interface"),
 		nil)
 	libvirtDomainInterfaceRxBytesDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_interface_stats", "receive_bytes_total"),
+		prometheus.BuildFQName(namespace, "domain_interface_stats", "receive_bytes_total"),
 		"Number of bytes received on a network interface, in bytes.",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
 		nil)
 	libvirtDomainInterfaceRxPacketsDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_interface_stats", "receive_packets_total"),
+		prometheus.BuildFQName(namespace, "domain_interface_stats", "receive_packets_total"),
 		"Number of packets received on a network interface.",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
 		nil)
 	libvirtDomainInterfaceRxErrsDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_interface_stats", "receive_errors_total"),
+		prometheus.BuildFQName(namespace, "domain_interface_stats", "receive_errors_total"),
 		"Number of packet receive errors on a network interface.",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
 		nil)
 	libvirtDomainInterfaceRxDropDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_interface_stats", "receive_drops_total"),
+		prometheus.BuildFQName(namespace, "domain_interface_stats", "receive_drops_total"),
 		"Number of packet receive drops on a network interface.",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
 		nil)
 	libvirtDomainInterfaceTxBytesDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_interface_stats", "transmit_bytes_total"),
+		prometheus.BuildFQName(namespace, "domain_interface_stats", "transmit_bytes_total"),
 		"Number of bytes transmitted on a network interface, in bytes.",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
 		nil)
 	libvirtDomainInterfaceTxPacketsDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_interface_stats", "transmit_packets_total"),
+		prometheus.BuildFQName(namespace, "domain_interface_stats", "transmit_packets_total"),
 		"Number of packets transmitted on a network interface.",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
 		nil)
 	libvirtDomainInterfaceTxErrsDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_interface_stats", "transmit_errors_total"),
+		prometheus.BuildFQName(namespace, "domain_interface_stats", "transmit_errors_total"),
 		"Number of packet transmit errors on a network interface.",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
 		nil)
 	libvirtDomainInterfaceTxDropDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_interface_stats", "transmit_drops_total"),
+		prometheus.BuildFQName(namespace, "domain_interface_stats", "transmit_drops_total"),
 		"Number of packet transmit drops on a network interface.",
-		[]string{"domain", "target_device"},
+		domainLabelNames("target_device"),
+		nil)
+	libvirtDomainInterfaceHostRxBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_interface_host", "receive_bytes_total"),
+		"Number of bytes received on the host tap device of a network interface, sent by the guest.",
+		domainLabelNames("target_device"),
+		nil)
+	libvirtDomainInterfaceHostRxPktsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_interface_host", "receive_packets_total"),
+		"Number of packets received on the host tap device of a network interface, sent by the guest.",
+		domainLabelNames("target_device"),
+		nil)
+	libvirtDomainInterfaceHostRxErrsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_interface_host", "receive_errors_total"),
+		"Number of packet receive errors on the host tap device of a network interface.",
+		domainLabelNames("target_device"),
+		nil)
+	libvirtDomainInterfaceHostRxDropDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_interface_host", "receive_drops_total"),
+		"Number of packet receive drops on the host tap device of a network interface.",
+		domainLabelNames("target_device"),
+		nil)
+	libvirtDomainInterfaceHostTxBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_interface_host", "transmit_bytes_total"),
+		"Number of bytes transmitted on the host tap device of a network interface, received by the guest.",
+		domainLabelNames("target_device"),
+		nil)
+	libvirtDomainInterfaceHostTxPktsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_interface_host", "transmit_packets_total"),
+		"Number of packets transmitted on the host tap device of a network interface, received by the guest.",
+		domainLabelNames("target_device"),
+		nil)
+	libvirtDomainInterfaceHostTxErrsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_interface_host", "transmit_errors_total"),
+		"Number of packet transmit errors on the host tap device of a network interface.",
+		domainLabelNames("target_device"),
+		nil)
+	libvirtDomainInterfaceHostTxDropDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_interface_host", "transmit_drops_total"),
+		"Number of packet transmit drops on the host tap device of a network interface.",
+		domainLabelNames("target_device"),
+		nil)
+	libvirtDomainInterfaceHostRxFifoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_interface_host", "receive_fifo_errors_total"),
+		"Number of receive FIFO overruns on the host tap device of a network interface.",
+		domainLabelNames("target_device"),
+		nil)
+	libvirtDomainInterfaceHostRxMulticastDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_interface_host", "receive_multicast_packets_total"),
+		"Number of multicast packets received on the host tap device of a network interface.",
+		domainLabelNames("target_device"),
+		nil)
+	libvirtDomainInterfaceHostRxCompressedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_interface_host", "receive_compressed_packets_total"),
+		"Number of compressed packets received on the host tap device of a network interface.",
+		domainLabelNames("target_device"),
+		nil)
+	libvirtDomainInterfaceHostTxFifoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_interface_host", "transmit_fifo_errors_total"),
+		"Number of transmit FIFO errors on the host tap device of a network interface.",
+		domainLabelNames("target_device"),
+		nil)
+	libvirtDomainInterfaceHostTxCompressedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_interface_host", "transmit_compressed_packets_total"),
+		"Number of compressed packets transmitted on the host tap device of a network interface.",
+		domainLabelNames("target_device"),
+		nil)
+	libvirtDomainInterfaceRxBitsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_interface_stats", "receive_bits_per_second"),
+		"Bits received per second on a network interface since the previous scrape.",
+		domainLabelNames("target_device"),
+		nil)
+	libvirtDomainInterfaceTxBitsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_interface_stats", "transmit_bits_per_second"),
+		"Bits transmitted per second on a network interface since the previous scrape.",
+		domainLabelNames("target_device"),
+		nil)
+	libvirtDomainInterfaceInboundAverageDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_interface", "inbound_average_bytes"),
+		"Configured average inbound bandwidth of a network interface, in bytes per second.",
+		domainLabelNames("target_device"),
+		nil)
+	libvirtDomainInterfaceInboundPeakDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_interface", "inbound_peak_bytes"),
+		"Configured peak inbound bandwidth of a network interface, in bytes per second.",
+		domainLabelNames("target_device"),
+		nil)
+	libvirtDomainInterfaceInboundBurstDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_interface", "inbound_burst_bytes"),
+		"Configured inbound burst size of a network interface, in bytes.",
+		domainLabelNames("target_device"),
+		nil)
+	libvirtDomainInterfaceOutboundAverageDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_interface", "outbound_average_bytes"),
+		"Configured average outbound bandwidth of a network interface, in bytes per second.",
+		domainLabelNames("target_device"),
+		nil)
+	libvirtDomainInterfaceOutboundPeakDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_interface", "outbound_peak_bytes"),
+		"Configured peak outbound bandwidth of a network interface, in bytes per second.",
+		domainLabelNames("target_device"),
+		nil)
+	libvirtDomainInterfaceQueuesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_interface", "queues"),
+		"Number of queues configured on the driver of a network interface.",
+		domainLabelNames("target_device"),
+		nil)
+	libvirtDomainInterfaceOutboundBurstDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_interface", "outbound_burst_bytes"),
+		"Configured outbound burst size of a network interface, in bytes.",
+		domainLabelNames("target_device"),
 		nil)
 
 	libvirtDomainMemoryStatMajorFaultTotalDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_memory_stats", "major_fault_total"),
+		prometheus.BuildFQName(namespace, "domain_memory_stats", "major_fault_total"),
 		"Page faults occur when a process makes a valid access to virtual memory that is not available. "+
-			"When servicing the page fault, if disk IO is required, it is considered a major fault.",
-		[]string{"domain"},
+			"When servicing the page fault, if disk IO is required, it is considered a major fault. This value is a count of faults.",
+		domainLabelNames(),
 		nil)
 	libvirtDomainMemoryStatMinorFaultTotalDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_memory_stats", "minor_fault_total"),
+		prometheus.BuildFQName(namespace, "domain_memory_stats", "minor_fault_total"),
 		"Page faults occur when a process makes a valid access to virtual memory that is not available. "+
-			"When servicing the page not fault, if disk IO is required, it is considered a minor fault.",
-		[]string{"domain"},
+			"When servicing the page fault, if disk IO is not required, it is considered a minor fault. This value is a count of faults.",
+		domainLabelNames(),
 		nil)
 	libvirtDomainMemoryStatUnusedBytesDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_memory_stats", "unused_bytes"),
+		prometheus.BuildFQName(namespace, "domain_memory_stats", "unused_bytes"),
 		"The amount of memory left completely unused by the system. Memory that is available but used for "+
 			"reclaimable caches should NOT be reported as free. This value is expressed in bytes.",
-		[]string{"domain"},
+		domainLabelNames(),
 		nil)
 	libvirtDomainMemoryStatAvailableBytesDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_memory_stats", "available_bytes"),
+		prometheus.BuildFQName(namespace, "domain_memory_stats", "available_bytes"),
 		"The total amount of usable memory as seen by the domain. This value may be less than the amount of "+
 			"memory assigned to the domain if a balloon driver is in use or if the guest OS does not initialize all "+
 			"assigned pages. This value is expressed in bytes.",
-		[]string{"domain"},
+		domainLabelNames(),
 		nil)
 	libvirtDomainMemoryStatActualBaloonBytesDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_memory_stats", "actual_balloon_bytes"),
-		"Current balloon value (in bytes).",
-		[]string{"domain"},
+		prometheus.BuildFQName(namespace, "domain_memory_stats", "actual_balloon_bytes"),
+		"Current balloon value. This value is expressed in bytes.",
+		domainLabelNames(),
 		nil)
 	libvirtDomainMemoryStatRssBytesDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_memory_stats", "rss_bytes"),
-		"Resident Set Size of the process running the domain. This value is in bytes",
-		[]string{"domain"},
+		prometheus.BuildFQName(namespace, "domain_memory_stats", "rss_bytes"),
+		"Resident Set Size of the process running the domain. This value is expressed in bytes.",
+		domainLabelNames(),
 		nil)
 	libvirtDomainMemoryStatUsableBytesDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_memory_stats", "usable_bytes"),
+		prometheus.BuildFQName(namespace, "domain_memory_stats", "usable_bytes"),
 		"How much the balloon can be inflated without pushing the guest system to swap, corresponds "+
-			"to 'Available' in /proc/meminfo",
-		[]string{"domain"},
+			"to 'Available' in /proc/meminfo. This value is expressed in bytes.",
+		domainLabelNames(),
 		nil)
 	libvirtDomainMemoryStatDiskCachesBytesDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_memory_stats", "disk_cache_bytes"),
-		"The amount of memory, that can be quickly reclaimed without additional I/O (in bytes)."+
-			"Typically these pages are used for caching files from disk.",
-		[]string{"domain"},
+		prometheus.BuildFQName(namespace, "domain_memory_stats", "disk_cache_bytes"),
+		"The amount of memory, that can be quickly reclaimed without additional I/O. "+
+			"Typically these pages are used for caching files from disk. This value is expressed in bytes.",
+		domainLabelNames(),
 		nil)
 	libvirtDomainMemoryStatUsedPercentDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_memory_stats", "used_percent"),
-		"The amount of memory in percent, that used by domain.",
-		[]string{"domain"},
+		prometheus.BuildFQName(namespace, "domain_memory_stats", "used_percent"),
+		"The amount of memory in percent, that used by domain. This value is a percentage of the available memory.",
+		domainLabelNames(),
 		nil)
+	libvirtDomainMemoryStatLastUpdateDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_memory_stats", "last_update_timestamp_seconds"),
+		"Unix time the balloon driver last updated the memory stats, stats from the guest are stale when it lags behind.",
+		domainLabelNames(),
+		nil)
+	libvirtDomainMemoryBalloonTargetDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_memory", "balloon_target_bytes"),
+		"Current balloon target of the domain, the memory the guest is asked to keep. It only differs from the "+
+			"actual balloon size while the balloon driver catches up. This value is expressed in bytes.",
+		domainLabelNames(),
+		nil)
+	libvirtDomainMemoryOverheadDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_memory", "overhead_bytes"),
+		"Resident memory of the QEMU process beyond the current memory of the guest, the memory the hypervisor and emulator take. This value is expressed in bytes.",
+		domainLabelNames(),
+		nil)
+	libvirtDomainMemoryStatPeriodDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_memory_stats", "period_seconds"),
+		"Period at which the balloon driver collects the memory stats from the guest, 0 when collection is disabled.",
+		domainLabelNames(),
+		nil)
+}
 
-	errorsMap map[string]struct{}
-
-	// The list of host processes
-	processes []int
+// mustNewConstMetric works like prometheus.MustNewConstMetric, but it
+// truncates the label values longer than --label.max-length, and types
+// counters as gauges with --metrics.counters-as-gauge.
+func mustNewConstMetric(desc *prometheus.Desc, valueType prometheus.ValueType, value float64, labelValues ...string) prometheus.Metric {
+	if valueType == prometheus.CounterValue && *metricsCountersAsGauge {
+		valueType = prometheus.GaugeValue
+	}
+	maxLength := *labelMaxLength
+	if maxLength > 0 {
+		truncated := labelValues
+		for i, labelValue := range labelValues {
+			if utf8.RuneCountInString(labelValue) <= maxLength {
+				continue
+			}
+			// The caller's slice may share its array with other label
+			// values, so it is copied rather than changed.
+			if &truncated[0] == &labelValues[0] {
+				truncated = append([]string(nil), labelValues...)
+			}
+			truncated[i] = truncateLabelValue(labelValue, maxLength)
+		}
+		labelValues = truncated
+	}
+	return prometheus.MustNewConstMetric(desc, valueType, value, labelValues...)
+}
 
-	// The path of the proc filesystem.
-	procFSPath = kingpin.Flag("path.procfs", "procfs mountpoint.").Default(procfs.DefaultMountPoint).String()
-)
+// truncateLabelValue truncates value to maxLength runes, ending it with an
+// ellipsis and the FNV-1a hash of the full value. Values sharing a long
+// prefix, such as the source files of the disks of a domain, would otherwise
+// end up the same and make duplicate series. The hash is kept whole for a
+// maxLength shorter than it.
+func truncateLabelValue(value string, maxLength int) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(value))
+	suffix := fmt.Sprintf("…%08x", h.Sum32())
+	keep := max(maxLength-utf8.RuneCountInString(suffix), 0)
+	return string([]rune(value)[:keep]) + suffix
+}
 
 // WriteErrorOnce writes message to stdout only once
 // for the error
 // "err" - an error message
 // "name" - name of an error, to count it
 func WriteErrorOnce(err string, name string, logger log.Logger) {
+	errorsMu.Lock()
+	defer errorsMu.Unlock()
 	if _, ok := errorsMap[name]; !ok {
 		_ = level.Error(logger).Log("err", err)
 		errorsMap[name] = struct{}{}
@@ -412,7 +1466,7 @@ func WriteErrorOnce(err string, name string, logger log.Logger) {
 }
 
 // GetDomainPid returns the VM's Pid by iterating over process list
-func GetDomainPid(domainName string) (pid int) {
+func GetDomainPid(processes []int, domainName string) (pid int) {
 	// lookup PID
 	for _, process := range processes {
 		cmdline := utils.GetCmdLine(*procFSPath, process)
@@ -437,7 +1491,11 @@ func GetDomainPid(domainName string) (pid int) {
 func GetDomainVcpuPids(domain *libvirt.Domain) (vCPUPids []int, err error) {
 	// NOTE(kiennt): For the libvirt version < v7.2.0, we have to self-calculate CPU steal
 	// Get the thread ids or VCPU's pid.
-	vCPUThreads, err := domain.QemuMonitorCommand("info cpus", libvirt.DOMAIN_QEMU_MONITOR_COMMAND_HMP)
+	var vCPUThreads string
+	err = instrumentCall("QemuMonitorCommand", func() (err error) {
+		vCPUThreads, err = domain.QemuMonitorCommand("info cpus", libvirt.DOMAIN_QEMU_MONITOR_COMMAND_HMP)
+		return err
+	})
 	if err != nil {
 		return vCPUPids, err
 	}
@@ -453,149 +1511,1129 @@ func GetDomainVcpuPids(domain *libvirt.Domain) (vCPUPids []int, err error) {
 	return
 }
 
-// CollectDomain extracts Prometheus metrics from a libvirt domain.
-func CollectDomain(ch chan<- prometheus.Metric, stat libvirt.DomainStats, logger log.Logger) error {
-	domainName, err := stat.Domain.GetName()
-	if err != nil {
-		return err
-	}
+// memoryUnits are the multipliers of the memory units of the domain XML,
+// KiB being the default.
+var memoryUnits = map[string]uint64{
+	"b": 1, "bytes": 1,
+	"": 1 << 10, "k": 1 << 10, "KiB": 1 << 10, "KB": 1000,
+	"M": 1 << 20, "MiB": 1 << 20, "MB": 1000 * 1000,
+	"G": 1 << 30, "GiB": 1 << 30, "GB": 1000 * 1000 * 1000,
+	"T": 1 << 40, "TiB": 1 << 40, "TB": 1000 * 1000 * 1000 * 1000,
+}
 
-	// Get Domain PID and its Vcpu Pids
-	domainPid := GetDomainPid(domainName)
-	domainVcpuPids, err := GetDomainVcpuPids(stat.Domain)
-	if err != nil {
-		lverr, ok := err.(libvirt.Error)
-		if !ok || lverr.Code != libvirt.ERR_OPERATION_INVALID {
-			return err
+// hugepageBackedBytes returns how much of the memory of the domain is backed
+// by hugepages. Hugepages restricted to a nodeset only back the guest NUMA
+// cells in it.
+func hugepageBackedBytes(desc libvirtSchema.Domain, memory uint64) uint64 {
+	hugepages := desc.MemoryBacking.Hugepages
+	if hugepages == nil {
+		return 0
+	}
+	cells := make(map[int]bool)
+	for _, page := range hugepages.Pages {
+		if page.Nodeset == "" {
+			return memory
+		}
+		nodes, err := parseNodeset(page.Nodeset)
+		if err != nil {
+			continue
 		}
+		for _, node := range nodes {
+			cells[node] = true
+		}
+	}
+	if len(cells) == 0 || len(desc.CPU.NUMA) == 0 {
+		return memory
+	}
+	var backed uint64
+	for _, cell := range desc.CPU.NUMA {
+		id, err := strconv.Atoi(cell.ID)
+		if err != nil || !cells[id] {
+			continue
+		}
+		backed += cell.Memory * memoryUnits[cell.Unit]
 	}
+	return backed
+}
 
-	domainUUID, err := stat.Domain.GetUUIDString()
-	if err != nil {
-		return err
+// parseNodeset parses a libvirt node or CPU set such as "0-3,^2,6" into the
+// sorted list of its members.
+func parseNodeset(nodeset string) ([]int, error) {
+	members := make(map[int]bool)
+	for _, part := range strings.Split(nodeset, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		exclude := strings.HasPrefix(part, "^")
+		part = strings.TrimPrefix(part, "^")
+		first, last, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("invalid nodeset %q: %w", nodeset, err)
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(last); err != nil {
+				return nil, fmt.Errorf("invalid nodeset %q: %w", nodeset, err)
+			}
+		}
+		for node := start; node <= end; node++ {
+			members[node] = !exclude
+		}
 	}
 
-	// Decode XML description of domain to get block device names, etc.
-	xmlDesc, err := stat.Domain.GetXMLDesc(0)
-	if err != nil {
-		return err
+	var nodes []int
+	for node, member := range members {
+		if member {
+			nodes = append(nodes, node)
+		}
 	}
-	var desc libvirtSchema.Domain
-	err = xml.Unmarshal([]byte(xmlDesc), &desc)
-	if err != nil {
-		return err
+	sort.Ints(nodes)
+	return nodes, nil
+}
+
+// storedSample holds a value kept across scrapes and when it was last seen.
+type storedSample[V any] struct {
+	value V
+	seen  time.Time
+}
+
+// sampleStore keeps values across scrapes, e.g. the counters of the previous
+// scrape to derive rates from. The zero value is an empty store.
+type sampleStore[K comparable, V any] struct {
+	mu      sync.Mutex
+	samples map[K]storedSample[V]
+}
+
+// get returns the value of key and when it was last set.
+func (s *sampleStore[K, V]) get(key K) (V, time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sample, ok := s.samples[key]
+	return sample.value, sample.seen, ok
+}
+
+// set sets the value of key, seen now.
+func (s *sampleStore[K, V]) set(key K, value V) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.samples == nil {
+		s.samples = make(map[K]storedSample[V])
 	}
+	s.samples[key] = storedSample[V]{value: value, seen: time.Now()}
+}
 
-	// Report domain info.
-	info, err := stat.Domain.GetInfo()
-	if err != nil {
-		return err
+// prune forgets the values not set since before, e.g. of deleted domains.
+func (s *sampleStore[K, V]) prune(before time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, sample := range s.samples {
+		if sample.seen.Before(before) {
+			delete(s.samples, key)
+		}
 	}
-	ch <- prometheus.MustNewConstMetric(
+}
+
+// blockRequests holds the request count and total time in nanoseconds of a
+// block device.
+type blockRequests struct {
+	reqs  uint64
+	times uint64
+}
+
+// blockLatency records the request count and total time in nanoseconds of
+// key and returns the average latency in seconds of the requests completed
+// since the previous sample. There is no latency for the first sample of
+// key, nor when the counters were reset.
+func blockLatency(store *sampleStore[string, blockRequests], key string, reqs, times uint64) (float64, bool) {
+	prev, _, ok := store.get(key)
+	store.set(key, blockRequests{reqs: reqs, times: times})
+	if !ok || reqs < prev.reqs || times < prev.times {
+		return 0, false
+	}
+	// Like iostat, an idle device reports a zero latency rather than none.
+	if reqs == prev.reqs {
+		return 0, true
+	}
+	return float64(times-prev.times) / float64(reqs-prev.reqs) / 1e9, true
+}
+
+// counterRate records the value of the counter key and returns its
+// per-second rate since the previous sample. There is no rate for the first
+// sample of key, nor for the first sample after the counter was reset, e.g.
+// by a restart of the domain.
+func counterRate(store *sampleStore[string, uint64], key string, value uint64) (float64, bool) {
+	prev, seen, ok := store.get(key)
+	store.set(key, value)
+	elapsed := time.Since(seen).Seconds()
+	if !ok || value < prev || elapsed <= 0 {
+		return 0, false
+	}
+	return float64(value-prev) / elapsed, true
+}
+
+// vcpuTimes holds the time and delay of a vcpu, in nanoseconds.
+type vcpuTimes struct {
+	time  uint64
+	delay uint64
+}
+
+// vcpuStealRatio records the CPU time and delay of the vcpu key and returns
+// the share of the delay in the time and delay since the previous sample.
+// There is no ratio for the first sample of key, after the counters were
+// reset, e.g. by a restart of the domain, nor when the vcpu neither ran nor
+// waited.
+func vcpuStealRatio(store *sampleStore[string, vcpuTimes], key string, cpuTime, delay uint64) (float64, bool) {
+	prev, _, ok := store.get(key)
+	store.set(key, vcpuTimes{time: cpuTime, delay: delay})
+	if !ok || cpuTime < prev.time || delay < prev.delay {
+		return 0, false
+	}
+	total := (cpuTime - prev.time) + (delay - prev.delay)
+	if total == 0 {
+		return 0, false
+	}
+	return float64(delay-prev.delay) / float64(total), true
+}
+
+// guestAgentPing holds the result of the last guest-ping of a domain.
+type guestAgentPing struct {
+	connected bool
+	pinged    time.Time
+}
+
+// guestAgentConnected returns whether the guest agent of key answered its
+// last guest-ping, calling ping when the last one is older than
+// --collect.guest-agent-interval.
+func guestAgentConnected(store *sampleStore[string, guestAgentPing], key string, ping func() bool) bool {
+	last, _, ok := store.get(key)
+	if ok && time.Since(last.pinged) < *collectGuestAgentInterval {
+		// Still seen, so that it isn't pruned.
+		store.set(key, last)
+		return last.connected
+	}
+
+	// The store isn't locked meanwhile, the ping may take a while.
+	now := time.Now()
+	connected := ping()
+	store.set(key, guestAgentPing{connected: connected, pinged: now})
+	return connected
+}
+
+// stateEntry holds the state of a domain and when it was first seen in it.
+type stateEntry struct {
+	state libvirt.DomainState
+	since time.Time
+}
+
+// enteredState records the state of key and returns when key was first seen
+// in it. A domain already in the state when the exporter started is taken
+// to have entered it then.
+func enteredState(store *sampleStore[string, stateEntry], key string, state libvirt.DomainState) time.Time {
+	entry, _, ok := store.get(key)
+	if !ok || entry.state != state {
+		entry = stateEntry{state: state, since: time.Now()}
+	}
+	store.set(key, entry)
+	return entry.since
+}
+
+// errorCount records whether an error happened for key and returns the
+// number of errors of key so far, to export them as counters.
+func errorCount(store *sampleStore[string, uint64], key string, failed bool) uint64 {
+	count, _, _ := store.get(key)
+	if failed {
+		count++
+	}
+	store.set(key, count)
+	return count
+}
+
+// domainCursor keeps the position of the next domain to collect when only
+// some domains are collected per scrape.
+type domainCursor struct {
+	mu   sync.Mutex
+	next int
+	// Start of the current and of the previous pass over all domains, the
+	// samples of domains not seen since the previous pass are forgotten.
+	passStart     time.Time
+	lastPassStart time.Time
+}
+
+// window returns the start and the length of the at most limit domains out
+// of total to collect now, wrapping around, and advances the cursor. It
+// also returns the start of the previous pass over all domains.
+func (c *domainCursor) window(total, limit int) (start, count int, lastPass time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if c.passStart.IsZero() {
+		c.passStart = now
+		c.lastPassStart = now
+	}
+	// Domains may have been deleted since the previous scrape.
+	if c.next >= total {
+		c.next = 0
+	}
+	if c.next == 0 {
+		c.lastPassStart = c.passStart
+		c.passStart = now
+	}
+	start, count = c.next, limit
+	if count > total {
+		count = total
+	}
+	c.next = (start + count) % max(total, 1)
+	return start, count, c.lastPassStart
+}
+
+// sampleStores keeps the counters of the previous scrape of a connection.
+type sampleStores struct {
+	blockLatencies    *sampleStore[string, blockRequests]
+	counterRates      *sampleStore[string, uint64]
+	guestAgents       *sampleStore[string, guestAgentPing]
+	hostnames         *sampleStore[string, string]
+	novaNames         *sampleStore[string, string]
+	poolRefreshErrors *sampleStore[string, uint64]
+	stateEntries      *sampleStore[string, stateEntry]
+	vcpuSteals        *sampleStore[string, vcpuTimes]
+	domainCursor      *domainCursor
+}
+
+// newSampleStores returns empty sample stores.
+func newSampleStores() *sampleStores {
+	return &sampleStores{
+		blockLatencies:    &sampleStore[string, blockRequests]{},
+		counterRates:      &sampleStore[string, uint64]{},
+		guestAgents:       &sampleStore[string, guestAgentPing]{},
+		hostnames:         &sampleStore[string, string]{},
+		novaNames:         &sampleStore[string, string]{},
+		poolRefreshErrors: &sampleStore[string, uint64]{},
+		stateEntries:      &sampleStore[string, stateEntry]{},
+		vcpuSteals:        &sampleStore[string, vcpuTimes]{},
+		domainCursor:      &domainCursor{},
+	}
+}
+
+// domainStateNames are the names of the domain states, indexed by
+// virDomainState.
+var domainStateNames = []string{"nostate", "running", "blocked", "paused", "shutdown", "shutoff", "crashed", "pmsuspended"}
+
+// isNoDomainError reports whether err is the libvirt error for a domain
+// that does not exist (anymore).
+func isNoDomainError(err error) bool {
+	var lverr libvirt.Error
+	return errors.As(err, &lverr) && lverr.Code == libvirt.ERR_NO_DOMAIN
+}
+
+// isUnsupportedError reports whether err is the libvirt error for a call the
+// driver doesn't implement. Drivers report it as either ERR_NO_SUPPORT or
+// ERR_OPERATION_UNSUPPORTED.
+func isUnsupportedError(err error) bool {
+	var lverr libvirt.Error
+	if !errors.As(err, &lverr) {
+		return false
+	}
+	return lverr.Code == libvirt.ERR_NO_SUPPORT || lverr.Code == libvirt.ERR_OPERATION_UNSUPPORTED
+}
+
+// domainError returns the error of the collection of a domain which fails
+// the scrape. A domain destroyed after its stats were gathered fails its
+// next calls, e.g. GetXMLDesc, with ERR_NO_DOMAIN, which is no reason to
+// fail the whole scrape, so it is skipped.
+func domainError(err error, logger log.Logger) error {
+	if isNoDomainError(err) {
+		_ = level.Debug(logger).Log("msg", "Domain disappeared during collection, skipping it", "err", err)
+		return nil
+	}
+	return err
+}
+
+// Self-metrics of the libvirt API calls made by the exporter, shared by all
+// the libvirt URIs, created by initDescs.
+var (
+	libvirtAPICallDuration *prometheus.HistogramVec
+	libvirtAPICalls        *prometheus.CounterVec
+)
+
+// libvirtUpName is the name of the libvirt_up metric in the configured
+// namespace, set by initDescs.
+var libvirtUpName string
+
+// instrumentCall runs a libvirt API call, recording its duration and result.
+func instrumentCall(name string, call func() error) error {
+	start := time.Now()
+	err := call()
+	libvirtAPICallDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	libvirtAPICalls.WithLabelValues(name, result).Inc()
+	return err
+}
+
+// transientRetryDelay is the pause before retrying a read call that failed
+// with a transient error.
+const transientRetryDelay = 100 * time.Millisecond
+
+// isTransientError reports whether err is a libvirt error that a busy
+// daemon returns now and then: a system error, an RPC failure or a timeout.
+func isTransientError(err error) bool {
+	var lverr libvirt.Error
+	if !errors.As(err, &lverr) {
+		return false
+	}
+	switch lverr.Code {
+	case libvirt.ERR_SYSTEM_ERROR, libvirt.ERR_RPC, libvirt.ERR_OPERATION_TIMEOUT:
+		return true
+	}
+	return false
+}
+
+// retryTransient runs an idempotent read call, retrying it once after a
+// short pause if it fails with a transient error. A single retry keeps an
+// overloaded daemon from being hammered.
+func retryTransient(call func() error) error {
+	err := call()
+	if err != nil && isTransientError(err) {
+		time.Sleep(transientRetryDelay)
+		err = call()
+	}
+	return err
+}
+
+// domainProjectUUID returns the UUID of the OpenStack project owning a
+// domain, read from its Nova metadata alone rather than its whole XML
+// description. It is empty for a domain without Nova metadata.
+func domainProjectUUID(domain *libvirt.Domain) string {
+	for _, namespace := range *metadataNovaNamespaces {
+		metadata, err := domain.GetMetadata(libvirt.DOMAIN_METADATA_ELEMENT, namespace, libvirt.DOMAIN_AFFECT_CURRENT)
+		if err != nil {
+			continue
+		}
+		var instance libvirtSchema.Instance
+		if xml.Unmarshal([]byte(metadata), &instance) != nil {
+			continue
+		}
+		return instance.NovaOwner.NovaProject.ProjectUUID
+	}
+	return ""
+}
+
+// domainCollection holds what the collection of the domains of a connection
+// shares.
+type domainCollection struct {
+	// Hypervisor type of the connection, as reported by virConnectGetType.
+	// Collection paths specific to QEMU are skipped for the other drivers.
+	driver string
+	// The list of host processes
+	processes []int
+	// Counters of the previous scrape of the connection
+	samples *sampleStores
+	// The connection the domains are collected from
+	conn *libvirt.Connect
+}
+
+// CollectDomain extracts Prometheus metrics from a libvirt domain.
+func CollectDomain(ch chan<- prometheus.Metric, stat libvirt.DomainStats, collection *domainCollection, logger log.Logger) error {
+	start := time.Now()
+	domainName, err := stat.Domain.GetName()
+	if err != nil {
+		return err
+	}
+
+	// A shut off domain has neither a process nor vcpus to report on.
+	shutoff := stat.State != nil && stat.State.StateSet && stat.State.State == libvirt.DOMAIN_SHUTOFF
+
+	// Get Domain PID and its Vcpu Pids, only QEMU has a monitor to ask for
+	// the vcpu threads.
+	var domainPid int
+	var domainVcpuPids []int
+	if collection.driver == qemuDriver && !shutoff {
+		domainPid = GetDomainPid(collection.processes, domainName)
+	}
+	if *collectVcpu && collection.driver == qemuDriver && !shutoff {
+		// The vcpu threads are named after their vcpu, which spares asking
+		// the monitor, only possible on a read-write connection.
+		if domainPid != 0 {
+			domainVcpuPids, _ = utils.GetVcpuThreadIDs(*procFSPath, domainPid)
+		}
+		if len(domainVcpuPids) == 0 {
+			domainVcpuPids, err = GetDomainVcpuPids(stat.Domain)
+			if err != nil {
+				lverr, ok := err.(libvirt.Error)
+				if !ok || lverr.Code != libvirt.ERR_OPERATION_INVALID {
+					return err
+				}
+			}
+		}
+	}
+
+	domainUUID, err := stat.Domain.GetUUIDString()
+	if err != nil {
+		return err
+	}
+
+	// Decode XML description of domain to get block device names, etc.
+	var xmlDesc string
+	err = retryTransient(func() (err error) {
+		xmlDesc, err = stat.Domain.GetXMLDesc(0)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	var desc libvirtSchema.Domain
+	err = xml.Unmarshal([]byte(xmlDesc), &desc)
+	if err != nil {
+		return err
+	}
+
+	domainLabels := domainLabelValues(domainName, desc.Metadata.NovaInstance.NovaName, domainUUID)
+	if *collectLifecycleEvents {
+		collection.samples.novaNames.set(domainUUID, desc.Metadata.NovaInstance.NovaName)
+	}
+	defer func() {
+		ch <- mustNewConstMetric(
+			libvirtDomainScrapeDurationDesc,
+			prometheus.GaugeValue,
+			time.Since(start).Seconds(),
+			domainLabels...)
+	}()
+
+	// Report domain info.
+	var info *libvirt.DomainInfo
+	err = retryTransient(func() (err error) {
+		info, err = stat.Domain.GetInfo()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	ch <- mustNewConstMetric(
 		libvirtDomainInfoMetaDesc,
 		prometheus.GaugeValue,
 		float64(1),
-		domainName,
-		domainUUID,
-		desc.Metadata.NovaInstance.NovaName,
-		desc.Metadata.NovaInstance.NovaFlavor.FlavorName,
-		desc.Metadata.NovaInstance.NovaOwner.NovaUser.UserName,
-		desc.Metadata.NovaInstance.NovaOwner.NovaUser.UserUUID,
-		desc.Metadata.NovaInstance.NovaOwner.NovaProject.ProjectName,
-		desc.Metadata.NovaInstance.NovaOwner.NovaProject.ProjectUUID,
-		desc.Metadata.NovaInstance.NovaRoot.RootType,
-		desc.Metadata.NovaInstance.NovaRoot.RootUUID)
-	ch <- prometheus.MustNewConstMetric(
+		append(domainLabels, domainMetaLabelValues(domainUUID,
+			desc.Metadata.NovaInstance.NovaName,
+			desc.Metadata.NovaInstance.NovaFlavor.FlavorName,
+			desc.Metadata.NovaInstance.NovaOwner.NovaUser.UserName,
+			desc.Metadata.NovaInstance.NovaOwner.NovaUser.UserUUID,
+			desc.Metadata.NovaInstance.NovaOwner.NovaProject.ProjectName,
+			desc.Metadata.NovaInstance.NovaOwner.NovaProject.ProjectUUID,
+			desc.Metadata.NovaInstance.NovaRoot.RootType,
+			desc.Metadata.NovaInstance.NovaRoot.RootUUID)...)...)
+	// virDomainInfo reports memory in KiB.
+	ch <- mustNewConstMetric(
 		libvirtDomainInfoMaxMemBytesDesc,
 		prometheus.GaugeValue,
 		float64(info.MaxMem)*1024,
-		domainName)
-	ch <- prometheus.MustNewConstMetric(
+		domainLabels...)
+	ch <- mustNewConstMetric(
 		libvirtDomainInfoMemoryUsageBytesDesc,
 		prometheus.GaugeValue,
 		float64(info.Memory)*1024,
-		domainName)
-	ch <- prometheus.MustNewConstMetric(
+		domainLabels...)
+	ch <- mustNewConstMetric(
 		libvirtDomainInfoNrVirtCPUDesc,
 		prometheus.GaugeValue,
 		float64(info.NrVirtCpu),
-		domainName)
-	ch <- prometheus.MustNewConstMetric(
+		domainLabels...)
+	vcpuMax, err := stat.Domain.GetVcpusFlags(libvirt.DOMAIN_VCPU_MAXIMUM)
+	if err != nil {
+		WriteErrorOnce("Unable to get the maximum number of vcpus: "+err.Error(), "vcpumax_unsupported", logger)
+	} else {
+		ch <- mustNewConstMetric(
+			libvirtDomainInfoVcpuMaxDesc,
+			prometheus.GaugeValue,
+			float64(vcpuMax),
+			domainLabels...)
+	}
+	ch <- mustNewConstMetric(
 		libvirtDomainInfoCPUTimeDesc,
 		prometheus.CounterValue,
 		float64(info.CpuTime)/1000/1000/1000, // From nsec to sec
-		domainName)
-	ch <- prometheus.MustNewConstMetric(
+		domainLabels...)
+	ch <- mustNewConstMetric(
 		libvirtDomainInfoVirDomainState,
 		prometheus.GaugeValue,
 		float64(info.State),
-		domainName)
+		domainLabels...)
+	if *metricsStateSeries {
+		for state, name := range domainStateNames {
+			var current float64
+			if libvirt.DomainState(state) == info.State {
+				current = 1
+			}
+			ch <- mustNewConstMetric(
+				libvirtDomainStateDesc,
+				prometheus.GaugeValue,
+				current,
+				append(domainLabels, name)...)
+		}
+	}
+	// A single scrape can't tell a domain stuck shutting down from one
+	// which just started to, so the time it entered the state is kept.
+	var stuck float64
+	stateEntered := enteredState(collection.samples.stateEntries, domainUUID, info.State)
+	if (info.State == libvirt.DOMAIN_SHUTDOWN || info.State == libvirt.DOMAIN_PMSUSPENDED) &&
+		time.Since(stateEntered) >= *collectTransientStateThreshold {
+		stuck = 1
+	}
+	ch <- mustNewConstMetric(
+		libvirtDomainInTransientStateDesc,
+		prometheus.GaugeValue,
+		stuck,
+		domainLabels...)
+	if stat.State != nil && stat.State.ReasonSet {
+		ch <- mustNewConstMetric(
+			libvirtDomainInfoStateReasonDesc,
+			prometheus.GaugeValue,
+			float64(stat.State.Reason),
+			domainLabels...)
+	}
 
-	domainStatsVcpu, err := stat.Domain.GetVcpus()
-	if err != nil {
-		lverr, ok := err.(libvirt.Error)
-		if !ok || lverr.Code != libvirt.ERR_OPERATION_INVALID {
-			return err
+	var tpmPresent float64
+	if len(desc.Devices.TPMs) > 0 {
+		tpmPresent = 1
+	}
+	ch <- mustNewConstMetric(
+		libvirtDomainTPMPresentDesc,
+		prometheus.GaugeValue,
+		tpmPresent,
+		domainLabels...)
+	var secureBootEnabled float64
+	if isSecureBootEnabled(desc.OS) {
+		secureBootEnabled = 1
+	}
+	ch <- mustNewConstMetric(
+		libvirtDomainSecureBootEnabledDesc,
+		prometheus.GaugeValue,
+		secureBootEnabled,
+		domainLabels...)
+	// Devices of the same kind sharing a label value are reported once.
+	if len(desc.Devices.Watchdogs) == 0 {
+		ch <- mustNewConstMetric(
+			libvirtDomainWatchdogPresentDesc,
+			prometheus.GaugeValue,
+			float64(0),
+			append(domainLabels, "")...)
+	}
+	watchdogActions := make(map[string]struct{})
+	for _, watchdog := range desc.Devices.Watchdogs {
+		if _, ok := watchdogActions[watchdog.Action]; ok {
+			continue
 		}
-	} else {
-		for _, vcpu := range domainStatsVcpu {
-			ch <- prometheus.MustNewConstMetric(
-				libvirtDomainVcpuStateDesc,
+		watchdogActions[watchdog.Action] = struct{}{}
+		ch <- mustNewConstMetric(
+			libvirtDomainWatchdogPresentDesc,
+			prometheus.GaugeValue,
+			float64(1),
+			append(domainLabels, watchdog.Action)...)
+	}
+	if len(desc.Devices.RNGs) == 0 {
+		ch <- mustNewConstMetric(
+			libvirtDomainRNGPresentDesc,
+			prometheus.GaugeValue,
+			float64(0),
+			append(domainLabels, "")...)
+	}
+	rngBackends := make(map[string]struct{})
+	for _, rng := range desc.Devices.RNGs {
+		if _, ok := rngBackends[rng.Backend.Model]; ok {
+			continue
+		}
+		rngBackends[rng.Backend.Model] = struct{}{}
+		ch <- mustNewConstMetric(
+			libvirtDomainRNGPresentDesc,
+			prometheus.GaugeValue,
+			float64(1),
+			append(domainLabels, rng.Backend.Model)...)
+	}
+
+	for _, controller := range desc.Devices.Controllers {
+		ch <- mustNewConstMetric(
+			libvirtDomainControllerInfoDesc,
+			prometheus.GaugeValue,
+			float64(1),
+			append(domainLabels, controller.Type, controller.Index, controller.Model)...)
+	}
+	// Desktop domains usually have several identical USB redirection
+	// devices, which make a single series.
+	peripherals := make(map[[4]string]struct{})
+	for _, device := range []struct {
+		name    string
+		devices []libvirtSchema.Peripheral
+	}{
+		{"sound", desc.Devices.Sounds},
+		{"input", desc.Devices.Inputs},
+		{"redirdev", desc.Devices.Redirdevs},
+	} {
+		for _, peripheral := range device.devices {
+			labels := [4]string{device.name, peripheral.Type, peripheral.Bus, peripheral.Model}
+			if _, ok := peripherals[labels]; ok {
+				continue
+			}
+			peripherals[labels] = struct{}{}
+			ch <- mustNewConstMetric(
+				libvirtDomainPeripheralInfoDesc,
 				prometheus.GaugeValue,
-				float64(vcpu.State),
-				domainName,
-				strconv.FormatInt(int64(vcpu.Number), 10))
+				float64(1),
+				append(domainLabels, labels[:]...)...)
+		}
+	}
+	for _, hostdev := range desc.Devices.Hostdevs {
+		ch <- mustNewConstMetric(
+			libvirtDomainHostdevInfoDesc,
+			prometheus.GaugeValue,
+			float64(1),
+			append(domainLabels, hostdev.Type, hostdevAddress(hostdev))...)
+	}
+	for _, filesystem := range desc.Devices.Filesystems {
+		ch <- mustNewConstMetric(
+			libvirtDomainFilesystemInfoDesc,
+			prometheus.GaugeValue,
+			float64(1),
+			append(domainLabels, filesystem.Source.Dir, filesystem.Target.Dir, filesystem.Driver.Type)...)
+	}
 
-			ch <- prometheus.MustNewConstMetric(
-				libvirtDomainVcpuTimeDesc,
-				prometheus.CounterValue,
-				float64(vcpu.CpuTime)/1000/1000/1000, // From nsec to sec
-				domainName,
-				strconv.FormatInt(int64(vcpu.Number), 10))
+	// The state of a virtio channel tells whether the guest side, such as
+	// the guest agent, is listening.
+	charDevices := make(map[[4]string]struct{})
+	for _, device := range []struct {
+		name    string
+		devices []libvirtSchema.CharDevice
+	}{
+		{"channel", desc.Devices.Channels},
+		{"console", desc.Devices.Consoles},
+	} {
+		for _, charDevice := range device.devices {
+			targetName := charDevice.Target.Name
+			if device.name == "console" {
+				targetName = charDevice.Target.Type
+			}
+			labels := [4]string{device.name, charDevice.Type, targetName, charDevice.Target.State}
+			if _, ok := charDevices[labels]; ok {
+				continue
+			}
+			charDevices[labels] = struct{}{}
+			ch <- mustNewConstMetric(
+				libvirtDomainChannelInfoDesc,
+				prometheus.GaugeValue,
+				float64(1),
+				append(domainLabels, labels[:]...)...)
+		}
+	}
 
-			ch <- prometheus.MustNewConstMetric(
-				libvirtDomainVcpuCPUDesc,
+	// Only domains with an agent channel have an agent to ping. A channel
+	// the guest doesn't listen on means there is no agent running, which
+	// spares waiting for the ping to time out.
+	if *collectGuestAgent && collection.driver == qemuDriver && !shutoff {
+		for _, channel := range desc.Devices.Channels {
+			if channel.Target.Name != guestAgentChannel {
+				continue
+			}
+			connected := channel.Target.State != "disconnected" && guestAgentConnected(collection.samples.guestAgents, domainUUID, func() bool {
+				err := instrumentCall("QemuAgentCommand", func() error {
+					_, err := stat.Domain.QemuAgentCommand(`{"execute":"guest-ping"}`, guestAgentTimeout, 0)
+					return err
+				})
+				if err != nil {
+					_ = level.Debug(logger).Log("msg", "guest agent didn't answer the guest-ping", "domain", domainName, "err", err)
+				}
+				return err == nil
+			})
+			value := 0
+			if connected {
+				value = 1
+			}
+			ch <- mustNewConstMetric(
+				libvirtDomainGuestAgentConnectedDesc,
 				prometheus.GaugeValue,
-				float64(vcpu.Cpu),
-				domainName,
-				strconv.FormatInt(int64(vcpu.Number), 10))
-		}
-
-		/* There's no Wait in GetVcpus()
-		 * But there's no cpu number in libvirt.DomainStats
-		 * Time and State are present in both structs
-		 * So, let's take Wait here
-		 */
-		for cpuNum, vcpu := range stat.Vcpu {
-			if vcpu.WaitSet {
-				ch <- prometheus.MustNewConstMetric(
-					libvirtDomainVcpuWaitDesc,
+				float64(value),
+				domainLabels...)
+			break
+		}
+	}
+
+	if desc.Devices.Vsock != nil {
+		ch <- mustNewConstMetric(
+			libvirtDomainVsockInfoDesc,
+			prometheus.GaugeValue,
+			float64(1),
+			append(domainLabels, desc.Devices.Vsock.CID.Address)...)
+	}
+
+	for _, feature := range desc.Features.HyperV.Features {
+		if feature.State != "on" {
+			continue
+		}
+		ch <- mustNewConstMetric(
+			libvirtDomainHyperVFeatureDesc,
+			prometheus.GaugeValue,
+			float64(1),
+			append(domainLabels, feature.XMLName.Local)...)
+	}
+
+	bootDevices := make(map[string]string)
+	for _, disk := range desc.Devices.Disks {
+		if disk.Boot.Order != "" {
+			bootDevices[disk.Target.Device] = disk.Boot.Order
+		}
+	}
+	for _, iface := range desc.Devices.Interfaces {
+		if iface.Boot.Order == "" {
+			continue
+		}
+		// The target device of an interface only exists while the domain
+		// runs.
+		device := iface.Target.Device
+		if device == "" {
+			device = iface.MAC.Address
+		}
+		bootDevices[device] = iface.Boot.Order
+	}
+	for device, order := range bootDevices {
+		bootOrder, err := strconv.ParseUint(order, 10, 32)
+		if err != nil {
+			continue
+		}
+		ch <- mustNewConstMetric(
+			libvirtDomainBootOrderDesc,
+			prometheus.GaugeValue,
+			float64(bootOrder),
+			append(domainLabels, device)...)
+	}
+
+	for _, graphics := range desc.Devices.Graphics {
+		listen := graphics.Listen
+		if listen == "" && len(graphics.Listens) > 0 {
+			listen = graphics.Listens[0].Address
+		}
+		ch <- mustNewConstMetric(
+			libvirtDomainGraphicsInfoDesc,
+			prometheus.GaugeValue,
+			float64(1),
+			append(domainLabels, graphics.Type, graphics.Port, listen)...)
+	}
+	// Several video devices may share a model, report it only once.
+	videoModels := make(map[string]struct{})
+	for _, video := range desc.Devices.Videos {
+		if _, ok := videoModels[video.Model.Type]; ok {
+			continue
+		}
+		videoModels[video.Model.Type] = struct{}{}
+		ch <- mustNewConstMetric(
+			libvirtDomainVideoInfoDesc,
+			prometheus.GaugeValue,
+			float64(1),
+			append(domainLabels, video.Model.Type)...)
+	}
+
+	ch <- mustNewConstMetric(
+		libvirtDomainOSInfoDesc,
+		prometheus.GaugeValue,
+		float64(1),
+		append(domainLabels, desc.OS.Type.Arch, desc.OS.Type.Machine, strings.TrimSpace(desc.OS.Type.Type))...)
+
+	// The live XML carries the model a host-model CPU was expanded to.
+	ch <- mustNewConstMetric(
+		libvirtDomainCPUInfoDesc,
+		prometheus.GaugeValue,
+		float64(1),
+		append(domainLabels, desc.CPU.Mode, strings.TrimSpace(desc.CPU.Model))...)
+	if topology := desc.CPU.Topology; topology.Sockets != "" {
+		ch <- mustNewConstMetric(
+			libvirtDomainCPUTopologyDesc,
+			prometheus.GaugeValue,
+			float64(1),
+			append(domainLabels, topology.Sockets, topology.Cores, topology.Threads)...)
+	}
+
+	// The inactive definition leaves out the runtime state, such as the
+	// domain id, the tap devices and the dynamic security labels.
+	if *collectConfigHash {
+		inactiveXMLDesc, err := stat.Domain.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE)
+		if err != nil {
+			_ = level.Debug(logger).Log("msg", "unable to get the inactive XML of the domain", "err", err)
+		} else {
+			ch <- mustNewConstMetric(
+				libvirtDomainConfigHashDesc,
+				prometheus.GaugeValue,
+				float64(configHash(inactiveXMLDesc)),
+				domainLabels...)
+		}
+	}
+
+	for _, secLabel := range desc.SecLabels {
+		ch <- mustNewConstMetric(
+			libvirtDomainSecLabelInfoDesc,
+			prometheus.GaugeValue,
+			float64(1),
+			append(domainLabels, secLabel.Model, secLabel.Type, secLabel.Relabel)...)
+	}
+
+	// Without an explicit source, guest memory is anonymous memory.
+	memoryBackingSource := desc.MemoryBacking.Source.Type
+	if memoryBackingSource == "" {
+		memoryBackingSource = "anonymous"
+	}
+	ch <- mustNewConstMetric(
+		libvirtDomainMemoryBackingInfoDesc,
+		prometheus.GaugeValue,
+		float64(1),
+		append(domainLabels, memoryBackingSource, strconv.FormatBool(desc.MemoryBacking.Hugepages != nil))...)
+	ch <- mustNewConstMetric(
+		libvirtDomainMemoryHugepageBackedDesc,
+		prometheus.GaugeValue,
+		float64(hugepageBackedBytes(desc, info.MaxMem*1024)),
+		domainLabels...)
+
+	// The host footprint of the QEMU process, emulator overhead included.
+	var processResidentMemory int
+	if domainPid != 0 {
+		procStat, err := utils.GetProcPIDStat(*procFSPath, domainPid)
+		if err != nil {
+			_ = level.Debug(logger).Log("msg", "unable to read the stat of the domain process", "err", err)
+		} else {
+			processResidentMemory = procStat.ResidentMemory()
+			ch <- mustNewConstMetric(
+				libvirtDomainProcessResidentMemDesc,
+				prometheus.GaugeValue,
+				float64(processResidentMemory),
+				domainLabels...)
+			ch <- mustNewConstMetric(
+				libvirtDomainProcessCPUSecondsDesc,
+				prometheus.CounterValue,
+				procStat.CPUTime(),
+				domainLabels...)
+		}
+		// Every disk and network interface takes file descriptors, a domain
+		// with many of them can run into the limit.
+		openFDs, maxFDs, err := utils.GetProcPIDFDs(*procFSPath, domainPid)
+		if err != nil {
+			_ = level.Debug(logger).Log("msg", "unable to read the file descriptors of the domain process", "err", err)
+		} else {
+			ch <- mustNewConstMetric(
+				libvirtDomainProcessOpenFDsDesc,
+				prometheus.GaugeValue,
+				float64(openFDs),
+				domainLabels...)
+			ch <- mustNewConstMetric(
+				libvirtDomainProcessMaxFDsDesc,
+				prometheus.GaugeValue,
+				float64(maxFDs),
+				domainLabels...)
+		}
+	}
+
+	if *collectVcpu && !shutoff {
+		var domainStatsVcpu []libvirt.DomainVcpuInfo
+		err := retryTransient(func() (err error) {
+			domainStatsVcpu, err = stat.Domain.GetVcpus()
+			return err
+		})
+		if err != nil {
+			lverr, ok := err.(libvirt.Error)
+			if !ok || lverr.Code != libvirt.ERR_OPERATION_INVALID {
+				return err
+			}
+		} else {
+			for _, vcpu := range domainStatsVcpu {
+				ch <- mustNewConstMetric(
+					libvirtDomainVcpuStateDesc,
+					prometheus.GaugeValue,
+					float64(vcpu.State),
+					append(domainLabels, strconv.FormatInt(int64(vcpu.Number), 10))...)
+
+				ch <- mustNewConstMetric(
+					libvirtDomainVcpuTimeDesc,
 					prometheus.CounterValue,
-					float64(vcpu.Wait)/1000/1000/1000,
-					domainName,
-					strconv.FormatInt(int64(cpuNum), 10))
+					float64(vcpu.CpuTime)/1000/1000/1000, // From nsec to sec
+					append(domainLabels, strconv.FormatInt(int64(vcpu.Number), 10))...)
+
+				ch <- mustNewConstMetric(
+					libvirtDomainVcpuCPUDesc,
+					prometheus.GaugeValue,
+					float64(vcpu.Cpu),
+					append(domainLabels, strconv.FormatInt(int64(vcpu.Number), 10))...)
 			}
-			if vcpu.DelaySet {
-				ch <- prometheus.MustNewConstMetric(
+
+			/* There's no Wait in GetVcpus()
+			 * But there's no cpu number in libvirt.DomainStats
+			 * Time and State are present in both structs
+			 * So, let's take Wait here
+			 *
+			 * The halt_poll_success_ns / halt_poll_fail_ns vcpu stats of
+			 * newer libvirt are not decoded by libvirt.DomainStatsVcpu,
+			 * so they can't be exported until the Go binding has them.
+			 */
+			for cpuNum, vcpu := range stat.Vcpu {
+				if vcpu.WaitSet {
+					ch <- mustNewConstMetric(
+						libvirtDomainVcpuWaitDesc,
+						prometheus.CounterValue,
+						float64(vcpu.Wait)/1000/1000/1000,
+						append(domainLabels, strconv.FormatInt(int64(cpuNum), 10))...)
+				}
+				delay := vcpu.Delay
+				if !vcpu.DelaySet {
+					// If there are no vcpu delay measurement, we calculate it ourselves.
+					if domainPid == 0 || cpuNum >= len(domainVcpuPids) || domainVcpuPids[cpuNum] == 0 {
+						continue
+					}
+					vcpuPid := domainVcpuPids[cpuNum]
+					procFSSchedStat, err := utils.GetProcPIDSchedStat(filepath.Join(*procFSPath, strconv.Itoa(domainPid), "task"), vcpuPid)
+					if err != nil {
+						WriteErrorOnce("Unable to collect vcpu delay metric: "+err.Error(), "vcpu_delay_"+domainUUID, logger)
+						continue
+					}
+					delay = procFSSchedStat.Runqueue
+				}
+				ch <- mustNewConstMetric(
 					libvirtDomainVcpuDelayDesc,
 					prometheus.CounterValue,
-					float64(vcpu.Delay)/1e9,
-					domainName,
-					strconv.FormatInt(int64(cpuNum), 10))
-			} else {
-				// If there are no vcpu delay measurement, we calculate it ourselves.
-				vcpuPid := domainVcpuPids[cpuNum]
-				procFSSchedStat, err := utils.GetProcPIDSchedStat(filepath.Join(*procFSPath, strconv.Itoa(domainPid), "task"), vcpuPid)
-				if err != nil {
-					_ = level.Error(logger).Log("err", "unable to collect vcpu delay metric", "msg", err)
+					float64(delay)/1e9,
+					append(domainLabels, strconv.FormatInt(int64(cpuNum), 10))...)
+
+				if *metricsVcpuStealRatio && vcpu.TimeSet {
+					if ratio, ok := vcpuStealRatio(collection.samples.vcpuSteals, domainUUID+"/vcpu/"+strconv.Itoa(cpuNum), vcpu.Time, delay); ok {
+						ch <- mustNewConstMetric(
+							libvirtDomainVcpuStealDesc,
+							prometheus.GaugeValue,
+							ratio,
+							append(domainLabels, strconv.FormatInt(int64(cpuNum), 10))...)
+					}
+				}
+			}
+		}
+	}
+	// libvirt only breaks the vcpu time down per host CPU for all the vcpus
+	// together, from the cpuacct cgroup, which cgroup v2 lacks.
+	if *collectVcpuCPUTime && !shutoff {
+		cpuStats, err := stat.Domain.GetCPUStats(0, 0, 0)
+		if err != nil {
+			WriteErrorOnce("Unable to get the per host CPU stats: "+err.Error(), "percpu_stats_unsupported", logger)
+		} else {
+			for cpu, cpuStat := range cpuStats {
+				if !cpuStat.VcpuTimeSet {
 					continue
 				}
-				ch <- prometheus.MustNewConstMetric(
-					libvirtDomainVcpuDelayDesc,
+				ch <- mustNewConstMetric(
+					libvirtDomainVcpuCPUTimeDesc,
 					prometheus.CounterValue,
-					float64(procFSSchedStat.Runqueue)/1e9,
-					domainName,
-					strconv.FormatInt(int64(cpuNum), 10))
+					float64(cpuStat.VcpuTime)/1e9,
+					append(domainLabels, strconv.Itoa(cpu))...)
+			}
+		}
+	}
+	if *collectSnapshots {
+		snapshotNum, err := stat.Domain.SnapshotNum(0)
+		if err != nil {
+			WriteErrorOnce("Unable to count snapshots: "+err.Error(), "snapshotnum_unsupported", logger)
+		} else {
+			ch <- mustNewConstMetric(
+				libvirtDomainSnapshotsDesc,
+				prometheus.GaugeValue,
+				float64(snapshotNum),
+				domainLabels...)
+		}
+	}
+
+	if *collectPinning {
+		emulatorPinInfo, err := stat.Domain.GetEmulatorPinInfo(libvirt.DOMAIN_AFFECT_CURRENT)
+		if err != nil {
+			WriteErrorOnce("Unable to get emulator pinning: "+err.Error(), "emulatorpin_unsupported", logger)
+		} else {
+			for cpu, pinned := range emulatorPinInfo {
+				if !pinned {
+					continue
+				}
+				ch <- mustNewConstMetric(
+					libvirtDomainEmulatorPinDesc,
+					prometheus.GaugeValue,
+					float64(1),
+					append(domainLabels, strconv.Itoa(cpu))...)
+			}
+		}
+
+		ioThreadInfo, err := stat.Domain.GetIOThreadInfo(libvirt.DOMAIN_AFFECT_CURRENT)
+		if err != nil {
+			WriteErrorOnce("Unable to get iothread pinning: "+err.Error(), "iothreadpin_unsupported", logger)
+		} else {
+			for _, ioThread := range ioThreadInfo {
+				for cpu, pinned := range ioThread.CpuMap {
+					if !pinned {
+						continue
+					}
+					ch <- mustNewConstMetric(
+						libvirtDomainIOThreadPinDesc,
+						prometheus.GaugeValue,
+						float64(1),
+						append(domainLabels, strconv.FormatUint(uint64(ioThread.IOThreadID), 10), strconv.Itoa(cpu))...)
+				}
+			}
+		}
+
+		numaParams, err := stat.Domain.GetNumaParameters(0)
+		if err != nil {
+			WriteErrorOnce("Unable to get numatune parameters: "+err.Error(), "numaparameters_unsupported", logger)
+		} else {
+			if numaParams.ModeSet {
+				ch <- mustNewConstMetric(
+					libvirtDomainNumatuneModeDesc,
+					prometheus.GaugeValue,
+					float64(numaParams.Mode),
+					domainLabels...)
+			}
+			if numaParams.NodesetSet {
+				nodes, err := parseNodeset(numaParams.Nodeset)
+				if err != nil {
+					_ = level.Error(logger).Log("err", "unable to parse numatune nodeset", "msg", err)
+				}
+				for _, node := range nodes {
+					ch <- mustNewConstMetric(
+						libvirtDomainNumatuneNodesetDesc,
+						prometheus.GaugeValue,
+						float64(1),
+						append(domainLabels, strconv.Itoa(node))...)
+				}
+			}
+		}
+	}
+
+	if *collectBlock {
+		blkioParams, err := stat.Domain.GetBlkioParameters(0)
+		if err != nil {
+			WriteErrorOnce("Unable to get blkio parameters: "+err.Error(), "blkioparameters_unsupported", logger)
+		} else {
+			if blkioParams.WeightSet {
+				ch <- mustNewConstMetric(
+					libvirtDomainBlkioWeightDesc,
+					prometheus.GaugeValue,
+					float64(blkioParams.Weight),
+					domainLabels...)
+			}
+			// DeviceWeight is a comma separated list of path,weight pairs.
+			if blkioParams.DeviceWeightSet && blkioParams.DeviceWeight != "" {
+				fields := strings.Split(blkioParams.DeviceWeight, ",")
+				for i := 0; i+1 < len(fields); i += 2 {
+					weight, err := strconv.ParseUint(fields[i+1], 10, 64)
+					if err != nil {
+						continue
+					}
+					ch <- mustNewConstMetric(
+						libvirtDomainBlkioDeviceWeightDesc,
+						prometheus.GaugeValue,
+						float64(weight),
+						append(domainLabels, fields[i])...)
+				}
 			}
 		}
 	}
@@ -624,113 +2662,257 @@ func CollectDomain(ch chan<- prometheus.Metric, stat libvirt.DomainStats, logger
 				break
 			}
 		}
+		// A disk hot-plugged between the stats and the XML has no definition
+		// yet, its stats are still reported.
+		if Device == nil {
+			Device = &libvirtSchema.Disk{}
+			if disk.PathSet {
+				DiskSource = disk.Path
+			}
+		}
+		// Discard requests are ignored by default when the driver doesn't set the mode.
+		discard := Device.Driver.Discard
+		if discard == "" {
+			discard = "ignore"
+		}
 
-		ch <- prometheus.MustNewConstMetric(
+		ch <- mustNewConstMetric(
 			libvirtDomainMetaBlockDesc,
 			prometheus.GaugeValue,
 			float64(1),
-			domainName,
-			disk.Name,
-			DiskSource,
-			Device.Serial,
-			Device.Target.Bus,
-			Device.DiskType,
-			Device.Driver.Type,
-			Device.Driver.Cache,
-			Device.Driver.Discard,
+			append(domainLabels, blockMetaLabelValues(
+				disk.Name,
+				DiskSource,
+				Device.Serial,
+				Device.WWN,
+				Device.Target.Bus,
+				Device.DiskType,
+				Device.Driver.Type,
+				Device.Driver.Cache,
+				discard,
+				strconv.FormatBool(Device.ReadOnly != nil))...)...,
 		)
+		ch <- mustNewConstMetric(
+			libvirtDomainBlockHWInfoDesc,
+			prometheus.GaugeValue,
+			float64(1),
+			append(domainLabels,
+				disk.Name,
+				Device.Target.RotationRate,
+				Device.BlockIO.LogicalBlockSize,
+				Device.BlockIO.PhysicalBlockSize,
+				Device.BlockIO.DiscardGranularity)...)
+		// Multi-queue is only reported when set explicitly in the domain XML.
+		if queues, err := strconv.ParseUint(Device.Driver.Queues, 10, 32); err == nil {
+			ch <- mustNewConstMetric(
+				libvirtDomainBlockQueuesDesc,
+				prometheus.GaugeValue,
+				float64(queues),
+				append(domainLabels, disk.Name)...)
+		}
+		// A disk is either assigned a single iothread, or its queues are
+		// spread over several.
+		ioThreads := make([]string, 0, 1)
+		if Device.Driver.IOThread != "" {
+			ioThreads = append(ioThreads, Device.Driver.IOThread)
+		}
+		for _, ioThread := range Device.Driver.IOThreads {
+			ioThreads = append(ioThreads, ioThread.ID)
+		}
+		for _, ioThread := range ioThreads {
+			ch <- mustNewConstMetric(
+				libvirtDomainBlockIOThreadDesc,
+				prometheus.GaugeValue,
+				float64(1),
+				append(domainLabels, disk.Name, ioThread)...)
+		}
 
 		// https://libvirt.org/html/libvirt-libvirt-domain.html#virConnectGetAllDomainStats
 		if disk.RdBytesSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- mustNewConstMetric(
 				libvirtDomainBlockRdBytesDesc,
 				prometheus.CounterValue,
 				float64(disk.RdBytes),
-				domainName,
-				disk.Name)
+				append(domainLabels, disk.Name)...)
 		}
 		if disk.RdReqsSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- mustNewConstMetric(
 				libvirtDomainBlockRdReqDesc,
 				prometheus.CounterValue,
 				float64(disk.RdReqs),
-				domainName,
-				disk.Name)
+				append(domainLabels, disk.Name)...)
 		}
 		if disk.RdTimesSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- mustNewConstMetric(
 				libvirtDomainBlockRdTotalTimeSecondsDesc,
 				prometheus.CounterValue,
 				float64(disk.RdTimes)/1e9,
-				domainName,
-				disk.Name)
+				append(domainLabels, disk.Name)...)
 		}
 		if disk.WrBytesSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- mustNewConstMetric(
 				libvirtDomainBlockWrBytesDesc,
 				prometheus.CounterValue,
 				float64(disk.WrBytes),
-				domainName,
-				disk.Name)
+				append(domainLabels, disk.Name)...)
 		}
 		if disk.WrReqsSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- mustNewConstMetric(
 				libvirtDomainBlockWrReqDesc,
 				prometheus.CounterValue,
 				float64(disk.WrReqs),
-				domainName,
-				disk.Name)
+				append(domainLabels, disk.Name)...)
 		}
 		if disk.WrTimesSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- mustNewConstMetric(
 				libvirtDomainBlockWrTotalTimesDesc,
 				prometheus.CounterValue,
 				float64(disk.WrTimes)/1e9,
-				domainName,
-				disk.Name)
+				append(domainLabels, disk.Name)...)
+		}
+		// The queue of the host device backing a file or block device
+		// source, which libvirt doesn't see.
+		if *collectBlockHost && disk.PathSet {
+			if hostStat, err := utils.GetBlockDevStat(*sysFSPath, disk.Path); err != nil {
+				_ = level.Debug(logger).Log("msg", "unable to read the host stat of the block device", "target_device", disk.Name, "err", err)
+			} else {
+				ch <- mustNewConstMetric(
+					libvirtDomainBlockHostIOInflightDesc,
+					prometheus.GaugeValue,
+					float64(hostStat.InFlight),
+					append(domainLabels, disk.Name)...)
+				ch <- mustNewConstMetric(
+					libvirtDomainBlockHostIOTimeDesc,
+					prometheus.CounterValue,
+					float64(hostStat.IOTicks)/1e3,
+					append(domainLabels, disk.Name)...)
+				ch <- mustNewConstMetric(
+					libvirtDomainBlockHostIOTimeWeightedDesc,
+					prometheus.CounterValue,
+					float64(hostStat.TimeInQueue)/1e3,
+					append(domainLabels, disk.Name)...)
+			}
+		}
+		if *metricsRates {
+			for _, counter := range []struct {
+				desc  *prometheus.Desc
+				name  string
+				set   bool
+				value uint64
+			}{
+				{libvirtDomainBlockRdIopsDesc, "rd_reqs", disk.RdReqsSet, disk.RdReqs},
+				{libvirtDomainBlockWrIopsDesc, "wr_reqs", disk.WrReqsSet, disk.WrReqs},
+				{libvirtDomainBlockRdBytesPerSecondDesc, "rd_bytes", disk.RdBytesSet, disk.RdBytes},
+				{libvirtDomainBlockWrBytesPerSecondDesc, "wr_bytes", disk.WrBytesSet, disk.WrBytes},
+			} {
+				if !counter.set {
+					continue
+				}
+				if rate, ok := counterRate(collection.samples.counterRates, domainUUID+"/block/"+disk.Name+"/"+counter.name, counter.value); ok {
+					ch <- mustNewConstMetric(
+						counter.desc,
+						prometheus.GaugeValue,
+						rate,
+						append(domainLabels, disk.Name)...)
+				}
+			}
+		}
+		if *metricsBlockLatency && disk.RdReqsSet && disk.RdTimesSet {
+			if latency, ok := blockLatency(collection.samples.blockLatencies, domainUUID+"/"+disk.Name+"/read", disk.RdReqs, disk.RdTimes); ok {
+				ch <- mustNewConstMetric(
+					libvirtDomainBlockRdLatencySecondsDesc,
+					prometheus.GaugeValue,
+					latency,
+					append(domainLabels, disk.Name)...)
+			}
+		}
+		if *metricsBlockLatency && disk.WrReqsSet && disk.WrTimesSet {
+			if latency, ok := blockLatency(collection.samples.blockLatencies, domainUUID+"/"+disk.Name+"/write", disk.WrReqs, disk.WrTimes); ok {
+				ch <- mustNewConstMetric(
+					libvirtDomainBlockWrLatencySecondsDesc,
+					prometheus.GaugeValue,
+					latency,
+					append(domainLabels, disk.Name)...)
+			}
 		}
 		if disk.FlReqsSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- mustNewConstMetric(
 				libvirtDomainBlockFlushReqDesc,
 				prometheus.CounterValue,
 				float64(disk.FlReqs),
-				domainName,
-				disk.Name)
+				append(domainLabels, disk.Name)...)
 		}
 		if disk.FlTimesSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- mustNewConstMetric(
 				libvirtDomainBlockFlushTotalTimeSecondsDesc,
 				prometheus.CounterValue,
 				float64(disk.FlTimes)/1e9,
-				domainName,
-				disk.Name)
+				append(domainLabels, disk.Name)...)
 		}
 		if disk.AllocationSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- mustNewConstMetric(
 				libvirtDomainBlockAllocationDesc,
 				prometheus.GaugeValue,
 				float64(disk.Allocation),
-				domainName,
-				disk.Name)
+				append(domainLabels, disk.Name)...)
+		}
+		// After an online blockresize some drivers keep reporting the old
+		// capacity in the domain stats, which an allocation beyond it gives
+		// away. virDomainGetBlockInfo then reports the current one.
+		capacity := disk.Capacity
+		if disk.CapacitySet && disk.AllocationSet && disk.Allocation > disk.Capacity {
+			var blockInfo *libvirt.DomainBlockInfo
+			err := instrumentCall("GetBlockInfo", func() (err error) {
+				blockInfo, err = stat.Domain.GetBlockInfo(disk.Name, 0)
+				return err
+			})
+			if err != nil {
+				_ = level.Debug(logger).Log("msg", "unable to get the block info of the device", "target_device", disk.Name, "err", err)
+			} else if blockInfo.Capacity > capacity {
+				capacity = blockInfo.Capacity
+			}
 		}
 		if disk.CapacitySet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- mustNewConstMetric(
 				libvirtDomainBlockCapacityBytesDesc,
 				prometheus.GaugeValue,
-				float64(disk.Capacity),
-				domainName,
-				disk.Name)
+				float64(capacity),
+				append(domainLabels, disk.Name)...)
+		} else if *collectBlockVolumeCapacity {
+			if capacity, ok := volumeCapacity(collection.conn, Device); ok {
+				ch <- mustNewConstMetric(
+					libvirtDomainBlockCapacityBytesDesc,
+					prometheus.GaugeValue,
+					float64(capacity),
+					append(domainLabels, disk.Name)...)
+			}
 		}
 		if disk.PhysicalSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- mustNewConstMetric(
 				libvirtDomainBlockPhysicalSizeBytesDesc,
 				prometheus.GaugeValue,
 				float64(disk.Physical),
-				domainName,
-				disk.Name)
+				append(domainLabels, disk.Name)...)
+		}
+		if disk.AllocationSet && disk.CapacitySet && capacity > 0 {
+			usedRatio := float64(disk.Allocation) / float64(capacity)
+			if usedRatio > 1 {
+				usedRatio = 1
+			}
+			ch <- mustNewConstMetric(
+				libvirtDomainBlockUsedRatioDesc,
+				prometheus.GaugeValue,
+				usedRatio,
+				append(domainLabels, disk.Name)...)
 		}
 
-		blockIOTuneParams, err := stat.Domain.GetBlockIoTune(disk.Name, 0)
+		// These are the configured limits only. Neither the block stats nor
+		// virDomainGetBlockIoTune tell how often a request was throttled.
+		var blockIOTuneParams *libvirt.DomainBlockIoTuneParameters
+		err = instrumentCall("GetBlockIoTune", func() (err error) {
+			blockIOTuneParams, err = stat.Domain.GetBlockIoTune(disk.Name, 0)
+			return err
+		})
 		if err != nil {
 			lverr, ok := err.(libvirt.Error)
 			if !ok {
@@ -745,452 +2927,1009 @@ func CollectDomain(ch chan<- prometheus.Metric, stat libvirt.DomainStats, logger
 				}
 			}
 		} else {
+			if blockIOTuneParams.GroupNameSet && blockIOTuneParams.GroupName != "" {
+				ch <- mustNewConstMetric(
+					libvirtDomainBlockIoTuneGroupDesc,
+					prometheus.GaugeValue,
+					float64(1),
+					append(domainLabels, disk.Name, blockIOTuneParams.GroupName)...)
+			}
 			if blockIOTuneParams.TotalBytesSecSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- mustNewConstMetric(
 					libvirtDomainBlockTotalBytesSecDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.TotalBytesSec),
-					domainName,
-					disk.Name)
+					append(domainLabels, disk.Name)...)
 			}
 			if blockIOTuneParams.ReadBytesSecSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- mustNewConstMetric(
 					libvirtDomainBlockReadBytesSecDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.ReadBytesSec),
-					domainName,
-					disk.Name)
+					append(domainLabels, disk.Name)...)
 			}
 			if blockIOTuneParams.WriteBytesSecSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- mustNewConstMetric(
 					libvirtDomainBlockWriteBytesSecDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.WriteBytesSec),
-					domainName,
-					disk.Name)
+					append(domainLabels, disk.Name)...)
 			}
 			if blockIOTuneParams.TotalIopsSecSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- mustNewConstMetric(
 					libvirtDomainBlockTotalIopsSecDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.TotalIopsSec),
-					domainName,
-					disk.Name)
+					append(domainLabels, disk.Name)...)
 			}
 			if blockIOTuneParams.ReadIopsSecSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- mustNewConstMetric(
 					libvirtDomainBlockReadIopsSecDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.ReadIopsSec),
-					domainName,
-					disk.Name)
+					append(domainLabels, disk.Name)...)
 			}
 			if blockIOTuneParams.WriteIopsSecSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- mustNewConstMetric(
 					libvirtDomainBlockWriteIopsSecDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.WriteIopsSec),
-					domainName,
-					disk.Name)
+					append(domainLabels, disk.Name)...)
 			}
 			if blockIOTuneParams.TotalBytesSecMaxSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- mustNewConstMetric(
 					libvirtDomainBlockTotalBytesSecMaxDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.TotalBytesSecMax),
-					domainName,
-					disk.Name)
+					append(domainLabels, disk.Name)...)
 			}
 			if blockIOTuneParams.ReadBytesSecMaxSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- mustNewConstMetric(
 					libvirtDomainBlockReadBytesSecMaxDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.ReadBytesSecMax),
-					domainName,
-					disk.Name)
+					append(domainLabels, disk.Name)...)
 			}
 			if blockIOTuneParams.WriteBytesSecMaxSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- mustNewConstMetric(
 					libvirtDomainBlockWriteBytesSecMaxDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.WriteBytesSecMax),
-					domainName,
-					disk.Name)
+					append(domainLabels, disk.Name)...)
 			}
 			if blockIOTuneParams.TotalIopsSecMaxSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- mustNewConstMetric(
 					libvirtDomainBlockTotalIopsSecMaxDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.TotalIopsSecMax),
-					domainName,
-					disk.Name)
+					append(domainLabels, disk.Name)...)
 			}
 			if blockIOTuneParams.ReadIopsSecMaxSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- mustNewConstMetric(
 					libvirtDomainBlockReadIopsSecMaxDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.ReadIopsSecMax),
-					domainName,
-					disk.Name)
+					append(domainLabels, disk.Name)...)
 			}
 			if blockIOTuneParams.WriteIopsSecMaxSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- mustNewConstMetric(
 					libvirtDomainBlockWriteIopsSecMaxDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.WriteIopsSecMax),
-					domainName,
-					disk.Name)
+					append(domainLabels, disk.Name)...)
 			}
 			if blockIOTuneParams.TotalBytesSecMaxLengthSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- mustNewConstMetric(
 					libvirtDomainBlockTotalBytesSecMaxLengthDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.TotalBytesSecMaxLength),
-					domainName,
-					disk.Name)
+					append(domainLabels, disk.Name)...)
 			}
 			if blockIOTuneParams.ReadBytesSecMaxLengthSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- mustNewConstMetric(
 					libvirtDomainBlockReadBytesSecMaxLengthDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.ReadBytesSecMaxLength),
-					domainName,
-					disk.Name)
+					append(domainLabels, disk.Name)...)
 			}
 			if blockIOTuneParams.WriteBytesSecMaxLengthSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- mustNewConstMetric(
 					libvirtDomainBlockWriteBytesSecMaxLengthDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.WriteBytesSecMaxLength),
-					domainName,
-					disk.Name)
+					append(domainLabels, disk.Name)...)
 			}
 			if blockIOTuneParams.TotalIopsSecMaxLengthSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- mustNewConstMetric(
 					libvirtDomainBlockTotalIopsSecMaxLengthDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.TotalIopsSecMaxLength),
-					domainName,
-					disk.Name)
+					append(domainLabels, disk.Name)...)
 			}
 			if blockIOTuneParams.ReadIopsSecMaxLengthSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- mustNewConstMetric(
 					libvirtDomainBlockReadIopsSecMaxLengthDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.ReadIopsSecMaxLength),
-					domainName,
-					disk.Name)
+					append(domainLabels, disk.Name)...)
 			}
 			if blockIOTuneParams.WriteIopsSecMaxLengthSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- mustNewConstMetric(
 					libvirtDomainBlockWriteIopsSecMaxLengthDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.WriteIopsSecMaxLength),
-					domainName,
-					disk.Name)
+					append(domainLabels, disk.Name)...)
 			}
 			if blockIOTuneParams.SizeIopsSecSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- mustNewConstMetric(
 					libvirtDomainBlockSizeIopsSecDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.SizeIopsSec),
-					domainName,
-					disk.Name)
+					append(domainLabels, disk.Name)...)
 			}
 		}
 	}
 
-	// Report network interface statistics.
+	// Report network interface statistics. libvirt only reports them
+	// aggregated over the queues of a multiqueue interface, per-queue
+	// counters would have to come from inside the guest.
 	for _, iface := range stat.Net {
 		var SourceBridge string
 		var VirtualInterface string
+		var Bandwidth libvirtSchema.InterfaceBandwidth
+		var Queues string
 		// Additional info for ovs network
 		for _, net := range desc.Devices.Interfaces {
 			if net.Target.Device == iface.Name {
 				SourceBridge = net.Source.Bridge
 				VirtualInterface = net.Virtualport.Parameters.InterfaceID
+				Bandwidth = net.Bandwidth
+				Queues = net.Driver.Queues
 				break
 			}
 		}
 		if SourceBridge != "" || VirtualInterface != "" {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- mustNewConstMetric(
 				libvirtDomainMetaInterfacesDesc,
 				prometheus.GaugeValue,
 				float64(1),
-				domainName,
-				SourceBridge,
-				iface.Name,
-				VirtualInterface)
+				append(domainLabels, SourceBridge, iface.Name, VirtualInterface)...)
+		}
+		if queues, err := strconv.ParseUint(Queues, 10, 32); err == nil {
+			ch <- mustNewConstMetric(
+				libvirtDomainInterfaceQueuesDesc,
+				prometheus.GaugeValue,
+				float64(queues),
+				append(domainLabels, iface.Name)...)
+		}
+		// Configured QoS limits, libvirt expresses rates in KiB/s and
+		// bursts in KiB.
+		for _, limit := range []struct {
+			desc  *prometheus.Desc
+			value string
+		}{
+			{libvirtDomainInterfaceInboundAverageDesc, Bandwidth.Inbound.Average},
+			{libvirtDomainInterfaceInboundPeakDesc, Bandwidth.Inbound.Peak},
+			{libvirtDomainInterfaceInboundBurstDesc, Bandwidth.Inbound.Burst},
+			{libvirtDomainInterfaceOutboundAverageDesc, Bandwidth.Outbound.Average},
+			{libvirtDomainInterfaceOutboundPeakDesc, Bandwidth.Outbound.Peak},
+			{libvirtDomainInterfaceOutboundBurstDesc, Bandwidth.Outbound.Burst},
+		} {
+			if limit.value == "" {
+				continue
+			}
+			kib, err := strconv.ParseUint(limit.value, 10, 64)
+			if err != nil {
+				continue
+			}
+			ch <- mustNewConstMetric(
+				limit.desc,
+				prometheus.GaugeValue,
+				float64(kib*1024),
+				append(domainLabels, iface.Name)...)
 		}
 		if iface.RxBytesSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- mustNewConstMetric(
 				libvirtDomainInterfaceRxBytesDesc,
 				prometheus.CounterValue,
 				float64(iface.RxBytes),
-				domainName,
-				iface.Name)
+				append(domainLabels, iface.Name)...)
 		}
 		if iface.RxPktsSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- mustNewConstMetric(
 				libvirtDomainInterfaceRxPacketsDesc,
 				prometheus.CounterValue,
 				float64(iface.RxPkts),
-				domainName,
-				iface.Name)
+				append(domainLabels, iface.Name)...)
 		}
 		if iface.RxErrsSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- mustNewConstMetric(
 				libvirtDomainInterfaceRxErrsDesc,
 				prometheus.CounterValue,
 				float64(iface.RxErrs),
-				domainName,
-				iface.Name)
+				append(domainLabels, iface.Name)...)
 		}
 		if iface.RxDropSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- mustNewConstMetric(
 				libvirtDomainInterfaceRxDropDesc,
 				prometheus.CounterValue,
 				float64(iface.RxDrop),
-				domainName,
-				iface.Name)
+				append(domainLabels, iface.Name)...)
 		}
 		if iface.TxBytesSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- mustNewConstMetric(
 				libvirtDomainInterfaceTxBytesDesc,
 				prometheus.CounterValue,
 				float64(iface.TxBytes),
-				domainName,
-				iface.Name)
+				append(domainLabels, iface.Name)...)
 		}
 		if iface.TxPktsSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- mustNewConstMetric(
 				libvirtDomainInterfaceTxPacketsDesc,
 				prometheus.CounterValue,
 				float64(iface.TxPkts),
-				domainName,
-				iface.Name)
+				append(domainLabels, iface.Name)...)
 		}
 		if iface.TxErrsSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- mustNewConstMetric(
 				libvirtDomainInterfaceTxErrsDesc,
 				prometheus.CounterValue,
 				float64(iface.TxErrs),
-				domainName,
-				iface.Name)
+				append(domainLabels, iface.Name)...)
+		}
+		if *metricsRates {
+			if iface.RxBytesSet {
+				if rate, ok := counterRate(collection.samples.counterRates, domainUUID+"/interface/"+iface.Name+"/rx_bytes", iface.RxBytes); ok {
+					ch <- mustNewConstMetric(
+						libvirtDomainInterfaceRxBitsDesc,
+						prometheus.GaugeValue,
+						rate*8,
+						append(domainLabels, iface.Name)...)
+				}
+			}
+			if iface.TxBytesSet {
+				if rate, ok := counterRate(collection.samples.counterRates, domainUUID+"/interface/"+iface.Name+"/tx_bytes", iface.TxBytes); ok {
+					ch <- mustNewConstMetric(
+						libvirtDomainInterfaceTxBitsDesc,
+						prometheus.GaugeValue,
+						rate*8,
+						append(domainLabels, iface.Name)...)
+				}
+			}
 		}
 		if iface.TxDropSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- mustNewConstMetric(
 				libvirtDomainInterfaceTxDropDesc,
 				prometheus.CounterValue,
 				float64(iface.TxDrop),
-				domainName,
-				iface.Name)
+				append(domainLabels, iface.Name)...)
+		}
+		// The counters of the tap device as seen by the host, receive on
+		// the host is transmit in the guest and vice versa.
+		if *collectInterfaceHost {
+			statistics, err := utils.GetNetDevStatistics(*sysFSPath, iface.Name)
+			if err != nil {
+				_ = level.Debug(logger).Log("msg", "unable to read the host statistics of the interface", "target_device", iface.Name, "err", err)
+				continue
+			}
+			for _, counter := range []struct {
+				desc *prometheus.Desc
+				name string
+			}{
+				{libvirtDomainInterfaceHostRxBytesDesc, "rx_bytes"},
+				{libvirtDomainInterfaceHostRxPktsDesc, "rx_packets"},
+				{libvirtDomainInterfaceHostRxErrsDesc, "rx_errors"},
+				{libvirtDomainInterfaceHostRxDropDesc, "rx_dropped"},
+				{libvirtDomainInterfaceHostTxBytesDesc, "tx_bytes"},
+				{libvirtDomainInterfaceHostTxPktsDesc, "tx_packets"},
+				{libvirtDomainInterfaceHostTxErrsDesc, "tx_errors"},
+				{libvirtDomainInterfaceHostTxDropDesc, "tx_dropped"},
+				{libvirtDomainInterfaceHostRxFifoDesc, "rx_fifo_errors"},
+				{libvirtDomainInterfaceHostRxMulticastDesc, "multicast"},
+				{libvirtDomainInterfaceHostRxCompressedDesc, "rx_compressed"},
+				{libvirtDomainInterfaceHostTxFifoDesc, "tx_fifo_errors"},
+				{libvirtDomainInterfaceHostTxCompressedDesc, "tx_compressed"},
+			} {
+				value, ok := statistics[counter.name]
+				if !ok {
+					continue
+				}
+				ch <- mustNewConstMetric(
+					counter.desc,
+					prometheus.CounterValue,
+					float64(value),
+					append(domainLabels, iface.Name)...)
+			}
 		}
 	}
 
-	// Collect Memory Stats
-	memorystat, err := stat.Domain.MemoryStats(11, 0)
-	var MemoryStats libvirtSchema.VirDomainMemoryStats
-	var usedPercent float64
-	if err == nil {
-		MemoryStats = memoryStatCollect(&memorystat)
-		if MemoryStats.Usable != 0 && MemoryStats.Available != 0 {
-			usedPercent = (float64(MemoryStats.Available) - float64(MemoryStats.Usable)) / (float64(MemoryStats.Available) / float64(100))
-		}
+	if *collectMemory {
+		// Collect Memory Stats
+		var memorystat []libvirt.DomainMemoryStat
+		err := instrumentCall("MemoryStats", func() (err error) {
+			memorystat, err = stat.Domain.MemoryStats(11, 0)
+			return err
+		})
+		var MemoryStats libvirtSchema.VirDomainMemoryStats
+		var usedPercent float64
+		if err == nil {
+			MemoryStats = memoryStatCollect(&memorystat)
+			if MemoryStats.Usable != 0 && MemoryStats.Available != 0 {
+				usedPercent = (float64(MemoryStats.Available) - float64(MemoryStats.Usable)) / (float64(MemoryStats.Available) / float64(100))
+			}
 
+		}
+		ch <- mustNewConstMetric(
+			libvirtDomainMemoryStatMajorFaultTotalDesc,
+			prometheus.CounterValue,
+			float64(MemoryStats.MajorFault),
+			domainLabels...)
+		ch <- mustNewConstMetric(
+			libvirtDomainMemoryStatMinorFaultTotalDesc,
+			prometheus.CounterValue,
+			float64(MemoryStats.MinorFault),
+			domainLabels...)
+		ch <- mustNewConstMetric(
+			libvirtDomainMemoryStatUnusedBytesDesc,
+			prometheus.GaugeValue,
+			float64(MemoryStats.Unused),
+			domainLabels...)
+		ch <- mustNewConstMetric(
+			libvirtDomainMemoryStatAvailableBytesDesc,
+			prometheus.GaugeValue,
+			float64(MemoryStats.Available),
+			domainLabels...)
+		ch <- mustNewConstMetric(
+			libvirtDomainMemoryStatActualBaloonBytesDesc,
+			prometheus.GaugeValue,
+			float64(MemoryStats.ActualBalloon),
+			domainLabels...)
+		ch <- mustNewConstMetric(
+			libvirtDomainMemoryStatRssBytesDesc,
+			prometheus.GaugeValue,
+			float64(MemoryStats.Rss),
+			domainLabels...)
+		ch <- mustNewConstMetric(
+			libvirtDomainMemoryStatUsableBytesDesc,
+			prometheus.GaugeValue,
+			float64(MemoryStats.Usable),
+			domainLabels...)
+		ch <- mustNewConstMetric(
+			libvirtDomainMemoryStatDiskCachesBytesDesc,
+			prometheus.GaugeValue,
+			float64(MemoryStats.DiskCaches),
+			domainLabels...)
+		ch <- mustNewConstMetric(
+			libvirtDomainMemoryStatUsedPercentDesc,
+			prometheus.GaugeValue,
+			float64(usedPercent),
+			domainLabels...)
+		// virDomainGetInfo reports the balloon target as the current memory.
+		ch <- mustNewConstMetric(
+			libvirtDomainMemoryBalloonTargetDesc,
+			prometheus.GaugeValue,
+			float64(info.Memory)*1024,
+			domainLabels...)
+		// What the QEMU process holds on top of the memory of the guest. It
+		// can't be told apart while the guest hasn't touched all its memory
+		// yet, the process then being smaller than the guest.
+		guestMemory := int(MemoryStats.ActualBalloon)
+		if processResidentMemory != 0 && guestMemory != 0 && processResidentMemory > guestMemory {
+			ch <- mustNewConstMetric(
+				libvirtDomainMemoryOverheadDesc,
+				prometheus.GaugeValue,
+				float64(processResidentMemory-guestMemory),
+				domainLabels...)
+		}
+		// The guest only reports stats once a period is set on the balloon.
+		if MemoryStats.LastUpdate != 0 {
+			ch <- mustNewConstMetric(
+				libvirtDomainMemoryStatLastUpdateDesc,
+				prometheus.GaugeValue,
+				float64(MemoryStats.LastUpdate),
+				domainLabels...)
+		}
+		if desc.Devices.MemBalloon.Model != "" && desc.Devices.MemBalloon.Model != "none" {
+			period, _ := strconv.ParseUint(desc.Devices.MemBalloon.Stats.Period, 10, 64)
+			ch <- mustNewConstMetric(
+				libvirtDomainMemoryStatPeriodDesc,
+				prometheus.GaugeValue,
+				float64(period),
+				domainLabels...)
+		}
 	}
-	ch <- prometheus.MustNewConstMetric(
-		libvirtDomainMemoryStatMajorFaultTotalDesc,
-		prometheus.CounterValue,
-		float64(MemoryStats.MajorFault),
-		domainName)
-	ch <- prometheus.MustNewConstMetric(
-		libvirtDomainMemoryStatMinorFaultTotalDesc,
-		prometheus.CounterValue,
-		float64(MemoryStats.MinorFault),
-		domainName)
-	ch <- prometheus.MustNewConstMetric(
-		libvirtDomainMemoryStatUnusedBytesDesc,
-		prometheus.GaugeValue,
-		float64(MemoryStats.Unused)*1024,
-		domainName)
-	ch <- prometheus.MustNewConstMetric(
-		libvirtDomainMemoryStatAvailableBytesDesc,
-		prometheus.GaugeValue,
-		float64(MemoryStats.Available)*1024,
-		domainName)
-	ch <- prometheus.MustNewConstMetric(
-		libvirtDomainMemoryStatActualBaloonBytesDesc,
-		prometheus.GaugeValue,
-		float64(MemoryStats.ActualBalloon)*1024,
-		domainName)
-	ch <- prometheus.MustNewConstMetric(
-		libvirtDomainMemoryStatRssBytesDesc,
-		prometheus.GaugeValue,
-		float64(MemoryStats.Rss)*1024,
-		domainName)
-	ch <- prometheus.MustNewConstMetric(
-		libvirtDomainMemoryStatUsableBytesDesc,
-		prometheus.GaugeValue,
-		float64(MemoryStats.Usable)*1024,
-		domainName)
-	ch <- prometheus.MustNewConstMetric(
-		libvirtDomainMemoryStatDiskCachesBytesDesc,
-		prometheus.GaugeValue,
-		float64(MemoryStats.DiskCaches)*1024,
-		domainName)
-	ch <- prometheus.MustNewConstMetric(
-		libvirtDomainMemoryStatUsedPercentDesc,
-		prometheus.GaugeValue,
-		float64(usedPercent),
-		domainName)
 
+	if stat.Perf != nil {
+		for _, event := range collectPerfEvents {
+			value, set, _ := perfEventValue(stat.Perf, event)
+			if !set {
+				continue
+			}
+			ch <- mustNewConstMetric(
+				libvirtDomainPerfEventsDesc,
+				prometheus.CounterValue,
+				float64(value),
+				append(domainLabels, event)...)
+		}
+	}
 	return nil
 }
 
-// Collect Storage pool stats
-func CollectStoragePool(ch chan<- prometheus.Metric, pool libvirt.StoragePool) error {
-	// Refresh pool
-	err := pool.Refresh(0)
+// volumeCapacity returns the capacity of the storage volume backing a disk
+// of a storage pool or an rbd image, for disks whose capacity libvirt doesn't
+// report in the domain stats. An rbd image is found by its pool/image name,
+// which is the path of the volume in a libvirt rbd pool.
+func volumeCapacity(conn *libvirt.Connect, disk *libvirtSchema.Disk) (uint64, bool) {
+	var vol *libvirt.StorageVol
+	var err error
+	switch {
+	case disk.DiskType == "volume" && disk.Source.Pool != "" && disk.Source.Volume != "":
+		pool, err := conn.LookupStoragePoolByName(disk.Source.Pool)
+		if err != nil {
+			return 0, false
+		}
+		defer pool.Free()
+		vol, err = pool.LookupStorageVolByName(disk.Source.Volume)
+		if err != nil {
+			return 0, false
+		}
+	case disk.DiskType == "network" && disk.Source.Protocol == "rbd" && disk.Source.Name != "":
+		vol, err = conn.LookupStorageVolByPath(disk.Source.Name)
+		if err != nil {
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+	defer vol.Free()
+	info, err := vol.GetInfo()
 	if err != nil {
-		return err
+		return 0, false
+	}
+	return info.Capacity, true
+}
+
+// isSecureBootEnabled reports whether the domain boots with secure boot, either
+// through a secure loader or through the firmware autoselection features.
+func isSecureBootEnabled(domainOS libvirtSchema.OS) bool {
+	if domainOS.Loader.Secure == "yes" {
+		return true
 	}
+	for _, feature := range domainOS.Firmware.Features {
+		if feature.Name == "secure-boot" && feature.Enabled == "yes" {
+			return true
+		}
+	}
+	return false
+}
+
+// hostdevAddress formats the host address of a passed through device the way
+// the host tools show it: domain:bus:slot.function for PCI devices,
+// bus:device for USB devices, adapter:bus:target:unit for SCSI devices and the
+// UUID of mediated devices.
+func hostdevAddress(hostdev libvirtSchema.Hostdev) string {
+	address := hostdev.Source.Address
+	number := func(value string) uint64 {
+		n, _ := strconv.ParseUint(value, 0, 64)
+		return n
+	}
+	switch hostdev.Type {
+	case "pci":
+		return fmt.Sprintf("%04x:%02x:%02x.%x", number(address.Domain), number(address.Bus), number(address.Slot), number(address.Function))
+	case "usb":
+		// USB devices may be selected by vendor and product instead.
+		if address.Bus == "" {
+			return hostdev.Source.Vendor.ID + ":" + hostdev.Source.Product.ID
+		}
+		return fmt.Sprintf("%03d:%03d", number(address.Bus), number(address.Device))
+	case "scsi":
+		return fmt.Sprintf("%s:%d:%d:%d", hostdev.Source.Adapter.Name, number(address.Bus), number(address.Target), number(address.Unit))
+	case "mdev":
+		return address.UUID
+	}
+	return ""
+}
+
+// Collect Storage pool stats
+func CollectStoragePool(ch chan<- prometheus.Metric, pool libvirt.StoragePool, samples *sampleStores, logger log.Logger) error {
 	pool_name, err := pool.GetName()
 	if err != nil {
 		return err
 	}
+	// Refresh pool. A pool which fails to refresh, e.g. an unreachable NFS
+	// pool, is skipped rather than failing the scrape.
+	if *collectPoolRefresh {
+		start := time.Now()
+		err = instrumentCall("StoragePoolRefresh", func() error {
+			return pool.Refresh(0)
+		})
+		ch <- mustNewConstMetric(
+			libvirtPoolRefreshDuration,
+			prometheus.GaugeValue,
+			time.Since(start).Seconds(),
+			pool_name)
+		refreshErrors := errorCount(samples.poolRefreshErrors, pool_name, err != nil)
+		ch <- mustNewConstMetric(
+			libvirtPoolRefreshErrors,
+			prometheus.CounterValue,
+			float64(refreshErrors),
+			pool_name)
+		if err != nil {
+			_ = level.Warn(logger).Log("msg", "failed to refresh storage pool", "pool", pool_name, "err", err)
+			return nil
+		}
+	}
 	pool_info, err := pool.GetInfo()
 	if err != nil {
 		return err
 	}
+	pool_autostart, err := pool.GetAutostart()
+	if err != nil {
+		return err
+	}
+	pool_persistent, err := pool.IsPersistent()
+	if err != nil {
+		return err
+	}
 	// Send metrics to channel
-	ch <- prometheus.MustNewConstMetric(
+	ch <- mustNewConstMetric(
 		libvirtPoolInfoCapacity,
 		prometheus.GaugeValue,
 		float64(pool_info.Capacity),
 		pool_name)
-	ch <- prometheus.MustNewConstMetric(
+	ch <- mustNewConstMetric(
 		libvirtPoolInfoAllocation,
 		prometheus.GaugeValue,
 		float64(pool_info.Allocation),
 		pool_name)
-	ch <- prometheus.MustNewConstMetric(
+	ch <- mustNewConstMetric(
 		libvirtPoolInfoAvailable,
 		prometheus.GaugeValue,
 		float64(pool_info.Available),
 		pool_name)
+	if pool_info.Capacity > 0 {
+		ch <- mustNewConstMetric(
+			libvirtPoolInfoUsedRatio,
+			prometheus.GaugeValue,
+			math.Min(float64(pool_info.Allocation)/float64(pool_info.Capacity), 1),
+			pool_name)
+	}
+	var autostart, persistent float64
+	if pool_autostart {
+		autostart = 1
+	}
+	if pool_persistent {
+		persistent = 1
+	}
+	ch <- mustNewConstMetric(
+		libvirtPoolInfoAutostart,
+		prometheus.GaugeValue,
+		autostart,
+		pool_name)
+	ch <- mustNewConstMetric(
+		libvirtPoolInfoPersistent,
+		prometheus.GaugeValue,
+		persistent,
+		pool_name)
 	return nil
 }
 
-// CollectFromLibvirt obtains Prometheus metrics from all domains in a
-// libvirt setup.
-func CollectFromLibvirt(ch chan<- prometheus.Metric, uri string, logger log.Logger) error {
-	conn, err := libvirt.NewConnect(uri)
+// CollectNodeDevices collects the PCI and mediated devices of the host, and
+// how many more mediated devices of each type the PCI devices can create.
+func CollectNodeDevices(ch chan<- prometheus.Metric, conn *libvirt.Connect, logger log.Logger) error {
+	devices, err := conn.ListAllNodeDevices(libvirt.CONNECT_LIST_NODE_DEVICES_CAP_PCI_DEV | libvirt.CONNECT_LIST_NODE_DEVICES_CAP_MDEV)
 	if err != nil {
+		if isUnsupportedError(err) {
+			WriteErrorOnce("Unsupported operation ListAllNodeDevices: "+err.Error(), "node_devices_unsupported", logger)
+			return nil
+		}
 		return err
 	}
-	defer conn.Close()
+	for i := range devices {
+		err = collectNodeDevice(ch, &devices[i])
+		devices[i].Free()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	hypervisorVersionNum, err := conn.GetVersion() // virConnectGetVersion, hypervisor running, e.g. QEMU
+// collectNodeDevice collects a PCI or mediated device from its XML.
+func collectNodeDevice(ch chan<- prometheus.Metric, device *libvirt.NodeDevice) error {
+	xmlDesc, err := device.GetXMLDesc(0)
+	if err != nil {
+		// The device was removed since it was listed, e.g. a deleted mdev.
+		if lverr, ok := err.(libvirt.Error); ok && lverr.Code == libvirt.ERR_NO_NODE_DEVICE {
+			return nil
+		}
+		return err
+	}
+	var desc libvirtSchema.NodeDevice
+	err = xml.Unmarshal([]byte(xmlDesc), &desc)
 	if err != nil {
 		return err
 	}
+	for _, capability := range desc.Capabilities {
+		if capability.Type != "pci" && capability.Type != "mdev" {
+			continue
+		}
+		ch <- mustNewConstMetric(
+			libvirtNodeDeviceInfoDesc,
+			prometheus.GaugeValue,
+			1,
+			desc.Name, desc.Driver.Name, capability.Type)
+		for _, nested := range capability.Capabilities {
+			if nested.Type != "mdev_types" {
+				continue
+			}
+			for _, mdevType := range nested.MdevTypes {
+				ch <- mustNewConstMetric(
+					libvirtNodeDeviceMdevAvailableDesc,
+					prometheus.GaugeValue,
+					float64(mdevType.AvailableInstances),
+					desc.Name, mdevType.ID)
+			}
+		}
+	}
+	return nil
+}
+
+// scrapeSummary counts the domains seen during a collection from libvirt.
+type scrapeSummary struct {
+	domainsTotal  int
+	domainsFailed int
+}
+
+// nextDomains returns the domains to collect by this scrape out of domains,
+// in turns ordered by UUID so that the turns hold while domains come and
+// go, and reports the position of the first one. It also returns the time
+// before which the samples of domains not collected since are forgotten.
+func nextDomains(ch chan<- prometheus.Metric, domains []*libvirt.Domain, uri string, cursor *domainCursor) ([]*libvirt.Domain, time.Time) {
+	uuids := make(map[*libvirt.Domain]string, len(domains))
+	for _, domain := range domains {
+		uuids[domain], _ = domain.GetUUIDString()
+	}
+	sort.SliceStable(domains, func(i, j int) bool {
+		return uuids[domains[i]] < uuids[domains[j]]
+	})
+
+	start, count, lastPass := cursor.window(len(domains), *collectMaxDomains)
+	ch <- mustNewConstMetric(
+		libvirtCollectCursorDesc,
+		prometheus.GaugeValue,
+		float64(start),
+		uriLabelValues(uri)...)
+
+	next := make([]*libvirt.Domain, 0, count)
+	for i := 0; i < count; i++ {
+		next = append(next, domains[(start+i)%len(domains)])
+	}
+	return next, lastPass
+}
+
+// CollectFromLibvirt obtains Prometheus metrics from all domains in a
+// libvirt setup, connected to with uri. The counters of the previous scrape
+// of the connection are in samples, and the domains it collects are counted
+// in summary.
+func CollectFromLibvirt(ch chan<- prometheus.Metric, conn *libvirt.Connect, uri string, samples *sampleStores, summary *scrapeSummary, logger log.Logger) error {
+	hypervisorVersionNum, err := conn.GetVersion() // virConnectGetVersion, hypervisor running, e.g. QEMU
+	if err != nil {
+		return &scrapeError{reason: "version", err: err}
+	}
 	hypervisorVersion := fmt.Sprintf("%d.%d.%d", hypervisorVersionNum/1000000%1000, hypervisorVersionNum/1000%1000, hypervisorVersionNum%1000)
 
 	libvirtdVersionNum, err := conn.GetLibVersion() // virConnectGetLibVersion, libvirt daemon running
 	if err != nil {
-		return err
+		return &scrapeError{reason: "version", err: err}
 	}
 	libvirtdVersion := fmt.Sprintf("%d.%d.%d", libvirtdVersionNum/1000000%1000, libvirtdVersionNum/1000%1000, libvirtdVersionNum%1000)
 
 	libraryVersionNum, err := libvirt.GetVersion() // virGetVersion, version of libvirt (dynamic) library used by this binary (exporter), not the daemon version
 	if err != nil {
-		return err
+		return &scrapeError{reason: "version", err: err}
+	}
+	libraryVersion := fmt.Sprintf("%d.%d.%d", libraryVersionNum/1000000%1000, libraryVersionNum/1000%1000, libraryVersionNum%1000)
+
+	driver, err := conn.GetType() // virConnectGetType, e.g. QEMU, Xen or LXC
+	if err != nil {
+		return &scrapeError{reason: "version", err: err}
+	}
+
+	collection := &domainCollection{driver: driver, samples: samples, conn: conn}
+
+	// Get all host processes in order to get the VM Pid.
+	if driver == qemuDriver {
+		collection.processes, err = utils.GetProcessList(*procFSPath)
+		if err != nil {
+			// Without procfs the vcpu delay can't be computed for libvirt
+			// versions lacking it, which is no reason to fail the scrape.
+			WriteErrorOnce("Unable to list host processes, vcpu delay is only reported when libvirt provides it: "+err.Error(), "procfs_unavailable", logger)
+		}
+	}
+
+	versionsInfoLabels := []string{hypervisorVersion, libvirtdVersion, libraryVersion}
+	if !*labelHostnameAll {
+		versionsInfoLabels = append(versionsInfoLabels, scrapeHostLabel(conn, uri, samples, logger))
+	}
+	versionsInfoLabels = append(versionsInfoLabels, uriLabelValues(uri)...)
+	ch <- mustNewConstMetric(
+		libvirtVersionsInfoDesc,
+		prometheus.GaugeValue,
+		1.0,
+		versionsInfoLabels...)
+
+	domains := []*libvirt.Domain{}
+	listed := *collectDomain != "" || len(*collectDomainUUIDs) > 0 || *collectProjectUUID != "" || *collectMaxDomains > 0
+	// Samples of domains not collected since are forgotten, when domains are
+	// collected in turns that is since the previous pass over all of them.
+	var pruneBefore time.Time
+	var statsFlags libvirt.ConnectGetAllDomainStatsFlags
+	if *collectDomain != "" {
+		// The state filters only apply to the listing of all domains, a
+		// named domain is collected whatever its state.
+		domain, err := conn.LookupDomainByName(*collectDomain)
+		if err != nil {
+			return err
+		}
+		defer domain.Free()
+		domains = append(domains, domain)
+	} else if len(*collectDomainUUIDs) > 0 {
+		// Likewise for the domains looked up by UUID, libvirt then only
+		// gathers the stats of these.
+		for _, uuid := range *collectDomainUUIDs {
+			domain, err := conn.LookupDomainByUUIDString(uuid)
+			if isNoDomainError(err) {
+				_ = level.Warn(logger).Log("msg", "domain to collect not found, skipping it", "uuid", uuid)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			defer domain.Free()
+			domains = append(domains, domain)
+		}
+	} else if *collectProjectUUID != "" || *collectMaxDomains > 0 {
+		// The domains of other projects, or beyond the ones collected by
+		// this scrape, are left out before their stats are gathered, the
+		// state filters then apply to the listing.
+		listFlags := libvirt.CONNECT_LIST_DOMAINS_RUNNING
+		if *collectIncludeShutoff {
+			listFlags |= libvirt.CONNECT_LIST_DOMAINS_SHUTOFF
+		}
+		allDomains, err := conn.ListAllDomains(listFlags)
+		if err != nil {
+			return err
+		}
+		for i := range allDomains {
+			domain := &allDomains[i]
+			if *collectProjectUUID != "" && domainProjectUUID(domain) != *collectProjectUUID {
+				domain.Free()
+				continue
+			}
+			defer domain.Free()
+			domains = append(domains, domain)
+		}
+		if *collectMaxDomains > 0 {
+			domains, pruneBefore = nextDomains(ch, domains, uri, samples.domainCursor)
+		}
+	} else {
+		statsFlags = libvirt.CONNECT_GET_ALL_DOMAINS_STATS_RUNNING
+		if *collectIncludeShutoff {
+			statsFlags |= libvirt.CONNECT_GET_ALL_DOMAINS_STATS_SHUTOFF
+		}
 	}
-	libraryVersion := fmt.Sprintf("%d.%d.%d", libraryVersionNum/1000000%1000, libraryVersionNum/1000%1000, libraryVersionNum%1000)
-
-	// Get all host processes in order to get the VM Pid.
-	processes = utils.GetProcessList(*procFSPath)
-
-	ch <- prometheus.MustNewConstMetric(
-		libvirtVersionsInfoDesc,
-		prometheus.GaugeValue,
-		1.0,
-		hypervisorVersion,
-		libvirtdVersion,
-		libraryVersion)
-
-	stats, err := conn.GetAllDomainStats([]*libvirt.Domain{}, libvirt.DOMAIN_STATS_STATE|libvirt.DOMAIN_STATS_CPU_TOTAL|
-		libvirt.DOMAIN_STATS_INTERFACE|libvirt.DOMAIN_STATS_BALLOON|libvirt.DOMAIN_STATS_BLOCK|
-		libvirt.DOMAIN_STATS_PERF|libvirt.DOMAIN_STATS_VCPU,
-		//libvirt.CONNECT_GET_ALL_DOMAINS_STATS_NOWAIT, // maybe in future
-		libvirt.CONNECT_GET_ALL_DOMAINS_STATS_RUNNING|libvirt.CONNECT_GET_ALL_DOMAINS_STATS_SHUTOFF)
-	defer func(stats []libvirt.DomainStats) {
-		for _, stat := range stats {
-			stat.Domain.Free()
-		}
-	}(stats)
-	if err != nil {
-		return err
+	// With NOWAIT, libvirt returns partial stats of a domain whose monitor is
+	// busy rather than blocking the whole scrape until it responds.
+	if *collectNoWait {
+		statsFlags |= libvirt.CONNECT_GET_ALL_DOMAINS_STATS_NOWAIT
 	}
-	for _, stat := range stats {
-		err = CollectDomain(ch, stat, logger)
+	var stats []libvirt.DomainStats
+	// An empty list of domains would get the stats of all of them.
+	if len(domains) > 0 || !listed {
+		err = instrumentCall("GetAllDomainStats", func() (err error) {
+			stats, err = conn.GetAllDomainStats(domains, domainStatsTypes(), statsFlags)
+			return err
+		})
+		defer func(stats []libvirt.DomainStats) {
+			for _, stat := range stats {
+				stat.Domain.Free()
+			}
+		}(stats)
 		if err != nil {
 			return err
 		}
 	}
+	summary.domainsTotal = len(stats)
+	if pruneBefore.IsZero() {
+		pruneBefore = time.Now()
+	}
+	if err = collectDomains(ch, stats, collection, summary, logger); err != nil {
+		return err
+	}
+	samples.blockLatencies.prune(pruneBefore)
+	samples.counterRates.prune(pruneBefore)
+	samples.guestAgents.prune(pruneBefore)
+	samples.novaNames.prune(pruneBefore)
+	samples.stateEntries.prune(pruneBefore)
+	samples.vcpuSteals.prune(pruneBefore)
 
 	// Collect pool info
 	pools, err := conn.ListAllStoragePools(libvirt.CONNECT_LIST_STORAGE_POOLS_ACTIVE)
 	if err != nil {
 		return err
 	}
+	poolsSeen := time.Now()
 	for _, pool := range pools {
-		err = CollectStoragePool(ch, pool)
+		err = CollectStoragePool(ch, pool, samples, logger)
 		pool.Free()
 		if err != nil {
 			return err
 		}
 	}
+	// Forget the refresh errors of the pools gone since.
+	samples.poolRefreshErrors.prune(poolsSeen)
+
+	if *collectNodeDevices {
+		return CollectNodeDevices(ch, conn, logger)
+	}
+	return nil
+}
+
+// collectDomains collects the domains of stats, counting those which fail.
+// Domains gone since their stats were gathered are skipped, neither failing
+// the scrape nor counted as failed.
+func collectDomains(ch chan<- prometheus.Metric, stats []libvirt.DomainStats, collection *domainCollection, summary *scrapeSummary, logger log.Logger) error {
+	for _, stat := range stats {
+		err := domainError(CollectDomain(ch, stat, collection, logger), logger)
+		if err != nil {
+			summary.domainsFailed++
+			return err
+		}
+	}
 	return nil
 }
 
+// domainStatsTypes returns the stats groups to request from GetAllDomainStats.
+// Groups of disabled collectors are left out, so that libvirt doesn't compute
+// stats which would be discarded.
+func domainStatsTypes() libvirt.DomainStatsTypes {
+	statsTypes := libvirt.DOMAIN_STATS_STATE | libvirt.DOMAIN_STATS_CPU_TOTAL
+	if *collectVcpu {
+		statsTypes |= libvirt.DOMAIN_STATS_VCPU
+	}
+	if *collectBlock {
+		statsTypes |= libvirt.DOMAIN_STATS_BLOCK
+	}
+	if *collectInterface {
+		statsTypes |= libvirt.DOMAIN_STATS_INTERFACE
+	}
+	if *collectMemory {
+		statsTypes |= libvirt.DOMAIN_STATS_BALLOON
+	}
+	if len(collectPerfEvents) > 0 {
+		statsTypes |= libvirt.DOMAIN_STATS_PERF
+	}
+	return statsTypes
+}
+
+// memoryStatValue converts a memory stat of a domain to the unit it is
+// exported in. As documented for virDomainMemoryStatTags, the fault and
+// hugetlb stats are counts and the last update is in seconds since the
+// epoch, they are kept as is. All the others are in KiB, converted to bytes.
+func memoryStatValue(tag libvirt.DomainMemoryStatTags, value uint64) uint64 {
+	switch tag {
+	case libvirt.DOMAIN_MEMORY_STAT_MAJOR_FAULT, libvirt.DOMAIN_MEMORY_STAT_MINOR_FAULT,
+		libvirt.DOMAIN_MEMORY_STAT_HUGETLB_PGALLOC, libvirt.DOMAIN_MEMORY_STAT_HUGETLB_PGFAIL,
+		libvirt.DOMAIN_MEMORY_STAT_LAST_UPDATE:
+		return value
+	}
+	return value * 1024
+}
+
+// memoryStatCollect maps the memory stats of a domain by tag, converted by
+// memoryStatValue.
 func memoryStatCollect(memorystat *[]libvirt.DomainMemoryStat) libvirtSchema.VirDomainMemoryStats {
 	var MemoryStats libvirtSchema.VirDomainMemoryStats
 	for _, domainmemorystat := range *memorystat {
-		switch tag := domainmemorystat.Tag; tag {
-		case 2:
-			MemoryStats.MajorFault = domainmemorystat.Val
-		case 3:
-			MemoryStats.MinorFault = domainmemorystat.Val
-		case 4:
-			MemoryStats.Unused = domainmemorystat.Val
-		case 5:
-			MemoryStats.Available = domainmemorystat.Val
-		case 6:
-			MemoryStats.ActualBalloon = domainmemorystat.Val
-		case 7:
-			MemoryStats.Rss = domainmemorystat.Val
-		case 8:
-			MemoryStats.Usable = domainmemorystat.Val
-		case 10:
-			MemoryStats.DiskCaches = domainmemorystat.Val
+		tag := libvirt.DomainMemoryStatTags(domainmemorystat.Tag)
+		value := memoryStatValue(tag, domainmemorystat.Val)
+		switch tag {
+		case libvirt.DOMAIN_MEMORY_STAT_MAJOR_FAULT:
+			MemoryStats.MajorFault = value
+		case libvirt.DOMAIN_MEMORY_STAT_MINOR_FAULT:
+			MemoryStats.MinorFault = value
+		case libvirt.DOMAIN_MEMORY_STAT_UNUSED:
+			MemoryStats.Unused = value
+		case libvirt.DOMAIN_MEMORY_STAT_AVAILABLE:
+			MemoryStats.Available = value
+		case libvirt.DOMAIN_MEMORY_STAT_ACTUAL_BALLOON:
+			MemoryStats.ActualBalloon = value
+		case libvirt.DOMAIN_MEMORY_STAT_RSS:
+			MemoryStats.Rss = value
+		case libvirt.DOMAIN_MEMORY_STAT_USABLE:
+			MemoryStats.Usable = value
+		case libvirt.DOMAIN_MEMORY_STAT_DISK_CACHES:
+			MemoryStats.DiskCaches = value
+		case libvirt.DOMAIN_MEMORY_STAT_LAST_UPDATE:
+			MemoryStats.LastUpdate = value
 		}
 	}
 	return MemoryStats
 }
 
+// Bounds of the exponential backoff between attempts to reconnect to libvirt.
+const (
+	minReconnectBackoff = time.Second
+	maxReconnectBackoff = 30 * time.Second
+)
+
+// eventLoopRetryDelay is the pause after a failed iteration of the libvirt
+// event loop, so that a persistent failure doesn't spin and flood the log.
+const eventLoopRetryDelay = time.Second
+
 // LibvirtExporter implements a Prometheus exporter for libvirt state.
 type LibvirtExporter struct {
-	uri    string
-	logger log.Logger
+	uri      string
+	cacheTTL time.Duration
+	logger   log.Logger
+
+	// Keepalive settings applied to every new connection, a zero interval
+	// keeps libvirt's default.
+	keepAliveInterval int
+	keepAliveCount    uint
+	// Deadline for opening a connection to libvirt.
+	connectTimeout time.Duration
+
+	// Counters of the previous scrape, to derive latencies and rates.
+	samples *sampleStores
+
+	// Persistent libvirt connection, reopened with a backoff when it dies.
+	connMu           sync.Mutex
+	conn             *libvirt.Connect
+	reconnectBackoff time.Duration
+	nextReconnect    time.Time
+
+	// Overlapping scrapes share a single collection from libvirt.
+	scrapeGroup singleflight.Group
+
+	// Metrics of the last successful scrape, served until they are older
+	// than cacheTTL.
+	cacheMu       sync.Mutex
+	cachedMetrics []prometheus.Metric
+	cachedAt      time.Time
+
+	// Time the last scrape of libvirt succeeded, zero until one does.
+	lastSuccessMu sync.Mutex
+	lastSuccess   time.Time
+
+	// Time of the last lifecycle event of every domain, with
+	// --collect.lifecycle-events, and when they were last exported.
+	eventsMu       sync.Mutex
+	lastEvents     map[lifecycleEventKey]time.Time
+	eventsExported time.Time
+}
+
+// lifecycleEventKey identifies a kind of lifecycle event of a domain.
+type lifecycleEventKey struct {
+	name  string
+	uuid  string
+	event string
 }
 
 // NewLibvirtExporter creates a new Prometheus exporter for libvirt.
-func NewLibvirtExporter(uri string, logger log.Logger) (*LibvirtExporter, error) {
+// A zero cacheTTL disables caching of the collected metrics and a zero
+// keepAliveInterval leaves the keepalive of the connection to libvirt.
+func NewLibvirtExporter(uri string, cacheTTL time.Duration, keepAliveInterval int, keepAliveCount uint, connectTimeout time.Duration, logger log.Logger) (*LibvirtExporter, error) {
 	return &LibvirtExporter{
-		uri:    uri,
-		logger: logger,
+		uri:               uri,
+		cacheTTL:          cacheTTL,
+		logger:            logger,
+		keepAliveInterval: keepAliveInterval,
+		keepAliveCount:    keepAliveCount,
+		connectTimeout:    connectTimeout,
+		samples:           newSampleStores(),
+		lastEvents:        make(map[lifecycleEventKey]time.Time),
 	}, nil
 }
 
@@ -1198,41 +3937,113 @@ func NewLibvirtExporter(uri string, logger log.Logger) (*LibvirtExporter, error)
 func (e *LibvirtExporter) Describe(ch chan<- *prometheus.Desc) {
 	// Status and versions
 	ch <- libvirtUpDesc
+	ch <- libvirtUpErrorDesc
+	ch <- libvirtLastScrapeSuccessDesc
 	ch <- libvirtVersionsInfoDesc
+	ch <- libvirtCacheHitDesc
+	ch <- libvirtCacheAgeDesc
+	ch <- libvirtCollectCursorDesc
 
 	// Pool info
 	ch <- libvirtPoolInfoCapacity
 	ch <- libvirtPoolInfoAllocation
 	ch <- libvirtPoolInfoAvailable
+	ch <- libvirtPoolInfoAutostart
+	ch <- libvirtPoolInfoPersistent
+	ch <- libvirtPoolInfoUsedRatio
+	ch <- libvirtPoolRefreshDuration
+	ch <- libvirtPoolRefreshErrors
+
+	// Node devices
+	ch <- libvirtNodeDeviceInfoDesc
+	ch <- libvirtNodeDeviceMdevAvailableDesc
 
 	// Domain info
 	ch <- libvirtDomainInfoMetaDesc
 	ch <- libvirtDomainInfoMaxMemBytesDesc
 	ch <- libvirtDomainInfoMemoryUsageBytesDesc
 	ch <- libvirtDomainInfoNrVirtCPUDesc
+	ch <- libvirtDomainInfoVcpuMaxDesc
 	ch <- libvirtDomainInfoCPUTimeDesc
 	ch <- libvirtDomainInfoVirDomainState
+	ch <- libvirtDomainStateDesc
+	ch <- libvirtDomainInTransientStateDesc
+	ch <- libvirtDomainInfoStateReasonDesc
+	ch <- libvirtDomainTPMPresentDesc
+	ch <- libvirtDomainSecureBootEnabledDesc
+	ch <- libvirtDomainWatchdogPresentDesc
+	ch <- libvirtDomainRNGPresentDesc
+	ch <- libvirtDomainControllerInfoDesc
+	ch <- libvirtDomainPeripheralInfoDesc
+	ch <- libvirtDomainHostdevInfoDesc
+	ch <- libvirtDomainFilesystemInfoDesc
+	ch <- libvirtDomainChannelInfoDesc
+	ch <- libvirtDomainGuestAgentConnectedDesc
+	ch <- libvirtDomainVsockInfoDesc
+	ch <- libvirtDomainHyperVFeatureDesc
+	ch <- libvirtDomainPerfEventsDesc
+	ch <- libvirtDomainBootOrderDesc
+	ch <- libvirtDomainSnapshotsDesc
+	ch <- libvirtDomainGraphicsInfoDesc
+	ch <- libvirtDomainVideoInfoDesc
+	ch <- libvirtDomainOSInfoDesc
+	ch <- libvirtDomainCPUInfoDesc
+	ch <- libvirtDomainCPUTopologyDesc
+	ch <- libvirtDomainConfigHashDesc
+	ch <- libvirtDomainSecLabelInfoDesc
+	ch <- libvirtDomainMemoryBackingInfoDesc
+	ch <- libvirtDomainMemoryHugepageBackedDesc
+	ch <- libvirtDomainScrapeDurationDesc
+	ch <- libvirtDomainProcessResidentMemDesc
+	ch <- libvirtDomainProcessCPUSecondsDesc
+	ch <- libvirtDomainProcessOpenFDsDesc
+	ch <- libvirtDomainProcessMaxFDsDesc
+	ch <- libvirtDomainLifecycleEventDesc
 
 	// VCPU info
 	ch <- libvirtDomainVcpuStateDesc
 	ch <- libvirtDomainVcpuTimeDesc
 	ch <- libvirtDomainVcpuDelayDesc
 	ch <- libvirtDomainVcpuCPUDesc
+	ch <- libvirtDomainVcpuCPUTimeDesc
 	ch <- libvirtDomainVcpuWaitDesc
+	ch <- libvirtDomainVcpuStealDesc
+
+	// Pinning info
+	ch <- libvirtDomainEmulatorPinDesc
+	ch <- libvirtDomainIOThreadPinDesc
+	ch <- libvirtDomainNumatuneModeDesc
+	ch <- libvirtDomainNumatuneNodesetDesc
 
 	// Domain block stats
 	ch <- libvirtDomainMetaBlockDesc
+	ch <- libvirtDomainBlockQueuesDesc
+	ch <- libvirtDomainBlockIOThreadDesc
+	ch <- libvirtDomainBlockHostIOInflightDesc
+	ch <- libvirtDomainBlockHostIOTimeDesc
+	ch <- libvirtDomainBlockHostIOTimeWeightedDesc
+	ch <- libvirtDomainBlockHWInfoDesc
 	ch <- libvirtDomainBlockRdBytesDesc
 	ch <- libvirtDomainBlockRdReqDesc
 	ch <- libvirtDomainBlockRdTotalTimeSecondsDesc
 	ch <- libvirtDomainBlockWrBytesDesc
 	ch <- libvirtDomainBlockWrReqDesc
 	ch <- libvirtDomainBlockWrTotalTimesDesc
+	ch <- libvirtDomainBlockRdLatencySecondsDesc
+	ch <- libvirtDomainBlockWrLatencySecondsDesc
+	ch <- libvirtDomainBlockRdIopsDesc
+	ch <- libvirtDomainBlockWrIopsDesc
+	ch <- libvirtDomainBlockRdBytesPerSecondDesc
+	ch <- libvirtDomainBlockWrBytesPerSecondDesc
 	ch <- libvirtDomainBlockFlushReqDesc
 	ch <- libvirtDomainBlockFlushTotalTimeSecondsDesc
 	ch <- libvirtDomainBlockAllocationDesc
 	ch <- libvirtDomainBlockCapacityBytesDesc
 	ch <- libvirtDomainBlockPhysicalSizeBytesDesc
+	ch <- libvirtDomainBlockUsedRatioDesc
+	ch <- libvirtDomainBlockIoTuneGroupDesc
+	ch <- libvirtDomainBlkioWeightDesc
+	ch <- libvirtDomainBlkioDeviceWeightDesc
 
 	// Domain net interfaces stats
 	ch <- libvirtDomainMetaInterfacesDesc
@@ -1244,6 +4055,28 @@ func (e *LibvirtExporter) Describe(ch chan<- *prometheus.Desc) {
 	ch <- libvirtDomainInterfaceTxPacketsDesc
 	ch <- libvirtDomainInterfaceTxErrsDesc
 	ch <- libvirtDomainInterfaceTxDropDesc
+	ch <- libvirtDomainInterfaceHostRxBytesDesc
+	ch <- libvirtDomainInterfaceHostRxPktsDesc
+	ch <- libvirtDomainInterfaceHostRxErrsDesc
+	ch <- libvirtDomainInterfaceHostRxDropDesc
+	ch <- libvirtDomainInterfaceHostTxBytesDesc
+	ch <- libvirtDomainInterfaceHostTxPktsDesc
+	ch <- libvirtDomainInterfaceHostTxErrsDesc
+	ch <- libvirtDomainInterfaceHostTxDropDesc
+	ch <- libvirtDomainInterfaceHostRxFifoDesc
+	ch <- libvirtDomainInterfaceHostRxMulticastDesc
+	ch <- libvirtDomainInterfaceHostRxCompressedDesc
+	ch <- libvirtDomainInterfaceHostTxFifoDesc
+	ch <- libvirtDomainInterfaceHostTxCompressedDesc
+	ch <- libvirtDomainInterfaceRxBitsDesc
+	ch <- libvirtDomainInterfaceTxBitsDesc
+	ch <- libvirtDomainInterfaceInboundAverageDesc
+	ch <- libvirtDomainInterfaceInboundPeakDesc
+	ch <- libvirtDomainInterfaceInboundBurstDesc
+	ch <- libvirtDomainInterfaceOutboundAverageDesc
+	ch <- libvirtDomainInterfaceOutboundPeakDesc
+	ch <- libvirtDomainInterfaceOutboundBurstDesc
+	ch <- libvirtDomainInterfaceQueuesDesc
 
 	// Domain memory stats
 	ch <- libvirtDomainMemoryStatMajorFaultTotalDesc
@@ -1254,23 +4087,579 @@ func (e *LibvirtExporter) Describe(ch chan<- *prometheus.Desc) {
 	ch <- libvirtDomainMemoryStatRssBytesDesc
 	ch <- libvirtDomainMemoryStatUsableBytesDesc
 	ch <- libvirtDomainMemoryStatDiskCachesBytesDesc
+	ch <- libvirtDomainMemoryStatLastUpdateDesc
+	ch <- libvirtDomainMemoryStatPeriodDesc
+	ch <- libvirtDomainMemoryOverheadDesc
+	ch <- libvirtDomainMemoryBalloonTargetDesc
+}
+
+// connect returns the persistent libvirt connection, opening a new one if
+// there is none yet or the previous one died. Failed attempts are retried
+// with an exponential backoff, scrapes arriving before the next attempt fail
+// right away instead of hammering an unavailable libvirtd.
+func (e *LibvirtExporter) connect() (*libvirt.Connect, error) {
+	e.connMu.Lock()
+	defer e.connMu.Unlock()
+
+	if e.conn != nil {
+		if alive, err := e.conn.IsAlive(); err == nil && alive {
+			return e.conn, nil
+		}
+		_, _ = e.conn.Close()
+		e.conn = nil
+	}
+
+	if wait := time.Until(e.nextReconnect); wait > 0 {
+		return nil, fmt.Errorf("not connected to libvirt, next attempt in %s", wait.Round(time.Millisecond))
+	}
+
+	conn, err := connectWithTimeout(e.uri, e.connectTimeout)
+	if err != nil {
+		e.reconnectBackoff *= 2
+		if e.reconnectBackoff < minReconnectBackoff {
+			e.reconnectBackoff = minReconnectBackoff
+		} else if e.reconnectBackoff > maxReconnectBackoff {
+			e.reconnectBackoff = maxReconnectBackoff
+		}
+		e.nextReconnect = time.Now().Add(e.reconnectBackoff)
+		return nil, err
+	}
+	if e.keepAliveInterval > 0 {
+		if err := conn.SetKeepAlive(e.keepAliveInterval, e.keepAliveCount); err != nil {
+			_ = level.Warn(e.logger).Log("msg", "failed to set keepalive on the libvirt connection", "err", err)
+		}
+	}
+	if *collectLifecycleEvents {
+		if _, err := conn.DomainEventLifecycleRegister(nil, e.handleLifecycleEvent); err != nil {
+			_ = level.Warn(e.logger).Log("msg", "failed to register for lifecycle events", "err", err)
+		}
+	}
+	e.reconnectBackoff = 0
+	e.conn = conn
+	return conn, nil
+}
+
+// handleLifecycleEvent records the time of a lifecycle event of a domain. It
+// runs on the libvirt event loop.
+func (e *LibvirtExporter) handleLifecycleEvent(_ *libvirt.Connect, d *libvirt.Domain, event *libvirt.DomainEventLifecycle) {
+	name, err := d.GetName()
+	if err != nil {
+		return
+	}
+	uuid, err := d.GetUUIDString()
+	if err != nil {
+		return
+	}
+	e.eventsMu.Lock()
+	e.lastEvents[lifecycleEventKey{name: name, uuid: uuid, event: lifecycleEventName(event.Event)}] = time.Now()
+	e.eventsMu.Unlock()
+}
+
+// collectLifecycleEvents sends the time of the last lifecycle events. The
+// Nova name of the domains is the one seen by the scrapes, the events of
+// domains no longer scraped, e.g. undefined, are forgotten once exported.
+func (e *LibvirtExporter) collectLifecycleEvents(ch chan<- prometheus.Metric) {
+	e.eventsMu.Lock()
+	defer e.eventsMu.Unlock()
+	for key, at := range e.lastEvents {
+		novaName, _, seen := e.samples.novaNames.get(key.uuid)
+		if !seen && at.Before(e.eventsExported) {
+			delete(e.lastEvents, key)
+			continue
+		}
+		ch <- mustNewConstMetric(
+			libvirtDomainLifecycleEventDesc,
+			prometheus.GaugeValue,
+			float64(at.UnixNano())/1e9,
+			append(domainLabelValues(key.name, novaName, key.uuid), key.event)...)
+	}
+	e.eventsExported = time.Now()
+}
+
+// lifecycleEventName returns the name virsh uses for a lifecycle event type.
+func lifecycleEventName(event libvirt.DomainEventType) string {
+	switch event {
+	case libvirt.DOMAIN_EVENT_DEFINED:
+		return "defined"
+	case libvirt.DOMAIN_EVENT_UNDEFINED:
+		return "undefined"
+	case libvirt.DOMAIN_EVENT_STARTED:
+		return "started"
+	case libvirt.DOMAIN_EVENT_SUSPENDED:
+		return "suspended"
+	case libvirt.DOMAIN_EVENT_RESUMED:
+		return "resumed"
+	case libvirt.DOMAIN_EVENT_STOPPED:
+		return "stopped"
+	case libvirt.DOMAIN_EVENT_SHUTDOWN:
+		return "shutdown"
+	case libvirt.DOMAIN_EVENT_PMSUSPENDED:
+		return "pmsuspended"
+	case libvirt.DOMAIN_EVENT_CRASHED:
+		return "crashed"
+	}
+	return strconv.Itoa(int(event))
+}
+
+// connectWithTimeout opens a connection to libvirt, giving up after timeout.
+// Opening a remote URI can hang for minutes on an unreachable host, so the
+// connection is opened in the background; one completing after the timeout
+// is closed right away.
+func connectWithTimeout(uri string, timeout time.Duration) (*libvirt.Connect, error) {
+	connectURI, err := withTransportParams(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		conn *libvirt.Connect
+		err  error
+	}
+	resultCh := make(chan result, 1)
+	abandoned := make(chan struct{})
+	go func() {
+		conn, err := libvirt.NewConnect(connectURI)
+		select {
+		case resultCh <- result{conn, err}:
+		case <-abandoned:
+			if err == nil {
+				_, _ = conn.Close()
+			}
+		}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-resultCh:
+		return r.conn, r.err
+	case <-timer.C:
+		close(abandoned)
+		return nil, fmt.Errorf("timed out connecting to %s after %s", uri, timeout)
+	}
+}
+
+// volatileConfigElements matches the elements of a domain definition that
+// change without the definition being edited.
+var volatileConfigElements = regexp.MustCompile(`(?s)<currentMemory\b.*?</currentMemory>`)
+
+// configHash returns the FNV-1a hash of a domain XML definition, with the
+// volatile elements and the indentation removed.
+func configHash(xmlDesc string) uint32 {
+	canonical := volatileConfigElements.ReplaceAllString(xmlDesc, "")
+	h := fnv.New32a()
+	for _, line := range strings.Split(canonical, "\n") {
+		_, _ = h.Write([]byte(strings.TrimSpace(line)))
+	}
+	return h.Sum32()
+}
+
+// withTransportParams adds the transport parameters given on the command
+// line to a remote URI: the pkipath to the URIs using TLS, libvirt's default
+// transport, and the ssh parameters to the URIs using ssh, but for
+// known_hosts which only the libssh and libssh2 transports take. Local URIs
+// are returned as is.
+func withTransportParams(uri string) (string, error) {
+	if libvirtPKIPath == "" && len(libvirtSSHParams) == 0 {
+		return uri, nil
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" {
+		return uri, nil
+	}
+	query := u.Query()
+	_, transport, _ := strings.Cut(u.Scheme, "+")
+	switch transport {
+	case "", "tls":
+		if libvirtPKIPath != "" {
+			query.Set("pkipath", libvirtPKIPath)
+		}
+	case "ssh", "libssh", "libssh2":
+		for name, values := range libvirtSSHParams {
+			// The ssh binary transport reads the known hosts from the ssh
+			// configuration, only the libssh ones take the parameter.
+			if name == "known_hosts" && transport == "ssh" {
+				continue
+			}
+			query[name] = values
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// uniqueURIs returns uris without the repeated ones, in order. Every URI gets
+// its own exporter, and two exporters of the same URI would register the same
+// descriptors with the same labels, which the registry refuses.
+func uniqueURIs(uris []string) []string {
+	unique := make([]string, 0, len(uris))
+	seen := make(map[string]bool, len(uris))
+	for _, uri := range uris {
+		if !seen[uri] {
+			seen[uri] = true
+			unique = append(unique, uri)
+		}
+	}
+	return unique
+}
+
+// socketURIs returns a qemu+unix URI for every libvirtd socket matching
+// pattern.
+func socketURIs(pattern string) ([]string, error) {
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	uris := make([]string, 0, len(paths))
+	for _, path := range paths {
+		// Slashes needn't be escaped in a query, keeping the uri label
+		// readable.
+		query := strings.ReplaceAll(url.Values{"socket": {path}}.Encode(), "%2F", "/")
+		uris = append(uris, "qemu+unix:///system?"+query)
+	}
+	return uris, nil
+}
+
+// exit removes the temporary pkipath directory, if any, and exits with
+// code, main never returning otherwise.
+func exit(code int) {
+	if libvirtPKIPath != "" {
+		_ = os.RemoveAll(libvirtPKIPath)
+	}
+	os.Exit(code)
+}
+
+// newPKIPath links the client certificate, key and CA certificate into a new
+// directory under the file names libvirt expects in a pkipath, since libvirt
+// only takes the directory rather than the individual files.
+func newPKIPath(cert, key, cacert string) (string, error) {
+	dir, err := os.MkdirTemp("", "libvirt-exporter-pki")
+	if err != nil {
+		return "", err
+	}
+	for name, file := range map[string]string{
+		"clientcert.pem": cert,
+		"clientkey.pem":  key,
+		"cacert.pem":     cacert,
+	} {
+		target, err := filepath.Abs(file)
+		if err == nil {
+			err = os.Symlink(target, filepath.Join(dir, name))
+		}
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// scrape collects the metrics from libvirt into a slice, so that the result
+// can be handed to every scrape waiting on it. Each collection ends with a
+// summary log line.
+func (e *LibvirtExporter) scrape() ([]prometheus.Metric, error) {
+	start := time.Now()
+	var summary scrapeSummary
+	var metrics []prometheus.Metric
+	metricCh := make(chan prometheus.Metric)
+	doneCh := make(chan struct{})
+	go func() {
+		for metric := range metricCh {
+			metrics = append(metrics, metric)
+		}
+		close(doneCh)
+	}()
+
+	conn, err := e.connect()
+	if err != nil {
+		err = &scrapeError{reason: connectErrorReason(err), err: err}
+	} else {
+		err = CollectFromLibvirt(metricCh, conn, e.uri, e.samples, &summary, e.logger)
+	}
+	close(metricCh)
+	<-doneCh
+
+	up := 0
+	if err == nil {
+		up = 1
+		e.lastSuccessMu.Lock()
+		e.lastSuccess = time.Now()
+		e.lastSuccessMu.Unlock()
+	}
+	_ = level.Info(e.logger).Log("msg", "Scrape finished", "uri", e.uri,
+		"domains_total", summary.domainsTotal, "domains_failed", summary.domainsFailed,
+		"duration_seconds", time.Since(start).Seconds(), "up", up)
+	return metrics, err
+}
+
+// upErrorReasons are the reasons of libvirt_up_error.
+var upErrorReasons = []string{"connect", "auth", "version", "stats"}
+
+// scrapeError is an error of a scrape, with the libvirt_up_error reason of
+// the step which failed.
+type scrapeError struct {
+	reason string
+	err    error
+}
+
+func (e *scrapeError) Error() string { return e.err.Error() }
+
+func (e *scrapeError) Unwrap() error { return e.err }
+
+// upErrorReason returns the libvirt_up_error reason of a scrape error, the
+// errors of the steps after the versions being about the stats. There is no
+// reason without an error.
+func upErrorReason(err error) string {
+	if err == nil {
+		return ""
+	}
+	var scrapeErr *scrapeError
+	if errors.As(err, &scrapeErr) {
+		return scrapeErr.reason
+	}
+	return "stats"
+}
+
+// connectErrorReason tells a connection refused by libvirt, which needs
+// fixing the credentials or the ACLs, from an unreachable libvirt.
+func connectErrorReason(err error) string {
+	var lverr libvirt.Error
+	if errors.As(err, &lverr) {
+		switch lverr.Code {
+		case libvirt.ERR_AUTH_FAILED, libvirt.ERR_AUTH_CANCELLED, libvirt.ERR_AUTH_UNAVAILABLE, libvirt.ERR_ACCESS_DENIED:
+			return "auth"
+		}
+	}
+	return "connect"
+}
+
+// cachedScrape returns the cached metrics while they are fresh, otherwise it
+// scrapes libvirt and refreshes the cache. It also reports whether the cache
+// was hit and the age of the returned metrics.
+func (e *LibvirtExporter) cachedScrape() ([]prometheus.Metric, bool, time.Duration, error) {
+	if e.cacheTTL > 0 {
+		e.cacheMu.Lock()
+		metrics, age := e.cachedMetrics, time.Since(e.cachedAt)
+		e.cacheMu.Unlock()
+		if metrics != nil && age < e.cacheTTL {
+			return metrics, true, age, nil
+		}
+	}
+
+	result, err, _ := e.scrapeGroup.Do(e.uri, func() (interface{}, error) {
+		metrics, err := e.scrape()
+		// Only successful scrapes are cached, a failing libvirt is retried
+		// on the next scrape.
+		if err == nil && e.cacheTTL > 0 {
+			e.cacheMu.Lock()
+			e.cachedMetrics, e.cachedAt = metrics, time.Now()
+			e.cacheMu.Unlock()
+		}
+		return metrics, err
+	})
+	return result.([]prometheus.Metric), false, 0, err
 }
 
 // Collect scrapes Prometheus metrics from libvirt.
 func (e *LibvirtExporter) Collect(ch chan<- prometheus.Metric) {
-	err := CollectFromLibvirt(ch, e.uri, e.logger)
+	metrics, cacheHit, cacheAge, err := e.cachedScrape()
+	// Const metrics are immutable, so the shared slice is only read here and
+	// its metrics can be sent to every caller without copying them.
+	for _, metric := range metrics {
+		ch <- metric
+	}
+	if *collectLifecycleEvents {
+		e.collectLifecycleEvents(ch)
+	}
+	if e.cacheTTL > 0 {
+		var hit float64
+		if cacheHit {
+			hit = 1
+		}
+		ch <- mustNewConstMetric(
+			libvirtCacheHitDesc,
+			prometheus.GaugeValue,
+			hit)
+		ch <- mustNewConstMetric(
+			libvirtCacheAgeDesc,
+			prometheus.GaugeValue,
+			cacheAge.Seconds())
+	}
 	if err == nil {
-		ch <- prometheus.MustNewConstMetric(
+		ch <- mustNewConstMetric(
 			libvirtUpDesc,
 			prometheus.GaugeValue,
-			1.0)
+			1.0,
+			uriLabelValues(e.uri)...)
 	} else {
 		_ = level.Error(e.logger).Log("err", "failed to scrape metrics", "uri", e.uri, "msg", err)
-		ch <- prometheus.MustNewConstMetric(
+		ch <- mustNewConstMetric(
 			libvirtUpDesc,
 			prometheus.GaugeValue,
-			0.0)
+			0.0,
+			uriLabelValues(e.uri)...)
+	}
+	failedReason := upErrorReason(err)
+	for _, reason := range upErrorReasons {
+		var failed float64
+		if reason == failedReason {
+			failed = 1
+		}
+		ch <- mustNewConstMetric(
+			libvirtUpErrorDesc,
+			prometheus.GaugeValue,
+			failed,
+			append(uriLabelValues(e.uri), reason)...)
+	}
+	e.lastSuccessMu.Lock()
+	lastSuccess := e.lastSuccess
+	e.lastSuccessMu.Unlock()
+	if !lastSuccess.IsZero() {
+		ch <- mustNewConstMetric(
+			libvirtLastScrapeSuccessDesc,
+			prometheus.GaugeValue,
+			float64(lastSuccess.UnixNano())/1e9,
+			uriLabelValues(e.uri)...)
+	}
+}
+
+// enabledCollectors returns the comma separated list of the optional
+// collections enabled on the command line.
+func enabledCollectors() string {
+	var collectors []string
+	for _, collector := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"vcpu", *collectVcpu},
+		{"block", *collectBlock},
+		{"interface", *collectInterface},
+		{"memory", *collectMemory},
+		{"interface-host", *collectInterfaceHost},
+		{"block-host", *collectBlockHost},
+		{"block-volume-capacity", *collectBlockVolumeCapacity},
+		{"snapshots", *collectSnapshots},
+		{"config-hash", *collectConfigHash},
+		{"pinning", *collectPinning},
+		{"guest-agent", *collectGuestAgent},
+		{"vcpu-cpu-time", *collectVcpuCPUTime},
+		{"pool-refresh", *collectPoolRefresh},
+		{"node-devices", *collectNodeDevices},
+		{"include-shutoff", *collectIncludeShutoff},
+		{"nowait", *collectNoWait},
+		{"rates", *metricsRates},
+		{"vcpu-steal-ratio", *metricsVcpuStealRatio},
+		{"block-latency", *metricsBlockLatency},
+		{"state-series", *metricsStateSeries},
+	} {
+		if collector.enabled {
+			collectors = append(collectors, collector.name)
+		}
+	}
+	return strings.Join(collectors, ",")
+}
+
+// newConfigInfo returns the <namespace>_exporter_config_info gauge,
+// describing the effective configuration of the exporter in its labels.
+func newConfigInfo(uris []string, cacheTTL, connectTimeout time.Duration) prometheus.Gauge {
+	schemes := make([]string, 0, len(uris))
+	for _, uri := range uris {
+		if u, err := url.Parse(uri); err == nil {
+			schemes = append(schemes, u.Scheme)
+		}
+	}
+	configInfo := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: *metricsNamespace + "_exporter",
+		Name:      "config_info",
+		Help:      "Effective configuration of the exporter. URI schemes, enabled collectors, cache TTL, connect timeout.",
+		ConstLabels: prometheus.Labels{
+			"uri_scheme":      strings.Join(schemes, ","),
+			"collectors":      enabledCollectors(),
+			"cache_ttl":       cacheTTL.String(),
+			"connect_timeout": connectTimeout.String(),
+		},
+	})
+	configInfo.Set(1)
+	return configInfo
+}
+
+// metricFilter is a prometheus.Gatherer that only passes on the metric
+// families matching the include globs and none of the exclude globs.
+// libvirt_up is always passed on, whatever its namespace.
+type metricFilter struct {
+	gatherer prometheus.Gatherer
+	include  []string
+	exclude  []string
+}
+
+// newMetricFilter returns a metricFilter for the given globs, or an error if
+// one of them is malformed.
+func newMetricFilter(gatherer prometheus.Gatherer, include, exclude []string) (*metricFilter, error) {
+	for _, pattern := range append(include, exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid metric name glob %q: %w", pattern, err)
+		}
+	}
+	return &metricFilter{gatherer: gatherer, include: include, exclude: exclude}, nil
+}
+
+func (f *metricFilter) matches(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Gather implements prometheus.Gatherer.
+func (f *metricFilter) Gather() ([]*dto.MetricFamily, error) {
+	families, err := f.gatherer.Gather()
+	filtered := families[:0]
+	for _, family := range families {
+		name := family.GetName()
+		if name != libvirtUpName {
+			if len(f.include) > 0 && !f.matches(f.include, name) {
+				continue
+			}
+			if f.matches(f.exclude, name) {
+				continue
+			}
+		}
+		filtered = append(filtered, family)
+	}
+	return filtered, err
+}
+
+// writeMetricsOnce gathers the metrics and writes them in the text format,
+// to check the connection to libvirt and the shape of the metrics without
+// serving them. It fails if any libvirt URI couldn't be scraped.
+func writeMetricsOnce(w io.Writer, gatherer prometheus.Gatherer) error {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	up := true
+	for _, family := range families {
+		if _, err := expfmt.MetricFamilyToText(w, family); err != nil {
+			return err
+		}
+		if family.GetName() != libvirtUpName {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if metric.GetGauge().GetValue() != 1 {
+				up = false
+			}
+		}
 	}
+	if !up {
+		return fmt.Errorf("failed to scrape libvirt")
+	}
+	return nil
 }
 
 // ConnectURI defines a type for driver URIs for libvirt
@@ -1278,6 +4667,15 @@ func (e *LibvirtExporter) Collect(ch chan<- prometheus.Metric) {
 // e.g. to connect remote via SSH
 type ConnectURI string
 
+// qemuDriver is the hypervisor type libvirt reports for QEMU/KVM connections.
+const qemuDriver = "QEMU"
+
+// guestAgentChannel is the target name of the channel of the QEMU guest agent.
+const guestAgentChannel = "org.qemu.guest_agent.0"
+
+// guestAgentTimeout is the time in seconds a guest-ping waits for the agent.
+const guestAgentTimeout = libvirt.DomainQemuAgentCommandTimeout(2)
+
 // See also https://libvirt.org/html/libvirt-libvirt-host.html#virConnectOpen
 const (
 	// QEMUSystem connects to a QEMU system mode daemon
@@ -1290,15 +4688,94 @@ const (
 	TestDefault ConnectURI = "test:///default"
 )
 
+// listenAndServe works like web.ListenAndServe, but it also accepts listen
+// addresses in the form unix:///path/to/socket to serve on a unix socket.
+// TLS and authentication from the web config apply to every listener.
+func listenAndServe(server *http.Server, flags *web.FlagConfig, logger log.Logger) error {
+	if *flags.WebSystemdSocket {
+		return web.ListenAndServe(server, flags, logger)
+	}
+
+	listeners := make([]net.Listener, 0, len(*flags.WebListenAddresses))
+	for _, address := range *flags.WebListenAddresses {
+		network := "tcp"
+		if path, ok := strings.CutPrefix(address, "unix://"); ok {
+			network, address = "unix", path
+		}
+		listener, err := net.Listen(network, address)
+		if err != nil {
+			return err
+		}
+		defer listener.Close()
+		listeners = append(listeners, listener)
+	}
+	return web.ServeMultiple(listeners, server, flags, logger)
+}
+
 func main() {
-	var libvirtURI = kingpin.Flag("libvirt.uri",
-		fmt.Sprintf("Libvirt URI to extract metrics, available value: %s (default), %s, %s and %s ",
+	var libvirtURIsSet bool
+	var libvirtURIs = kingpin.Flag("libvirt.uri",
+		fmt.Sprintf("Libvirt URI to extract metrics, available value: %s (default), %s, %s and %s. Repeatable for multiple URIs.",
 			QEMUSystem, QEMUSession, XenSystem, TestDefault),
-	).Default(string(QEMUSystem)).String()
+	).Default(string(QEMUSystem)).IsSetByUser(&libvirtURIsSet).Strings()
+	uriGlob := kingpin.Flag(
+		"libvirt.uri-glob", "Glob of libvirtd sockets, such as /var/run/libvirt-hosts/*/libvirt-sock, each collected through a qemu+unix URI. Expanded once at startup, --libvirt.uri then has no default",
+	).Default("").String()
+	keepAliveInterval := kingpin.Flag(
+		"libvirt.keepalive-interval", "Interval in seconds between keepalive messages on the libvirt connection, 0 keeps libvirt's default",
+	).Default("0").Int()
+	keepAliveCount := kingpin.Flag(
+		"libvirt.keepalive-count", "Number of keepalive messages left unanswered before the libvirt connection is considered dead",
+	).Default("5").Uint()
+	connectTimeout := kingpin.Flag(
+		"libvirt.connect-timeout", "Timeout for opening the connection to libvirt",
+	).Default("5s").Duration()
+	tlsCert := kingpin.Flag(
+		"libvirt.tls.cert", "Path to the client certificate for remote TLS URIs, requires --libvirt.tls.key and --libvirt.tls.cacert",
+	).Default("").String()
+	tlsKey := kingpin.Flag(
+		"libvirt.tls.key", "Path to the client private key for remote TLS URIs",
+	).Default("").String()
+	tlsCACert := kingpin.Flag(
+		"libvirt.tls.cacert", "Path to the CA certificate for remote TLS URIs",
+	).Default("").String()
+	sshKeyFile := kingpin.Flag(
+		"libvirt.ssh.keyfile", "Path to the private key for ssh URIs",
+	).Default("").String()
+	sshKnownHosts := kingpin.Flag(
+		"libvirt.ssh.known-hosts", "Path to the known hosts file for libssh and libssh2 URIs",
+	).Default("").String()
+	sshNoVerify := kingpin.Flag(
+		"libvirt.ssh.no-verify", "Don't verify the host key of ssh URIs, which leaves the connection open to man-in-the-middle attacks",
+	).Default("false").Bool()
 
 	metricsPath := kingpin.Flag(
 		"web.telemetry-path", "Path under which to expose metrics",
 	).Default("/metrics").String()
+	disableLandingPage := kingpin.Flag(
+		"web.disable-landing-page", "Don't serve the landing page, / returns 404 unless it is the telemetry path",
+	).Default("false").Bool()
+	cacheTTL := kingpin.Flag(
+		"cache.ttl", "Duration for which the collected metrics are cached and served to scrapes, 0 disables the cache",
+	).Default("0s").Duration()
+	metricsInclude := kingpin.Flag(
+		"metrics.include", "Glob of the metric names to export, all metrics are exported when unset. Repeatable for multiple globs.",
+	).Strings()
+	metricsExclude := kingpin.Flag(
+		"metrics.exclude", "Glob of the metric names not to export, applied after --metrics.include. Repeatable for multiple globs.",
+	).Strings()
+	dryRun := kingpin.Flag(
+		"dry-run", "Collect the metrics once, print them to stdout and exit, with a non-zero status if libvirt couldn't be scraped",
+	).Default("false").Bool()
+	readHeaderTimeout := kingpin.Flag(
+		"web.read-header-timeout", "Maximum duration for reading the headers of a request",
+	).Default("10s").Duration()
+	readTimeout := kingpin.Flag(
+		"web.read-timeout", "Maximum duration for reading an entire request",
+	).Default("30s").Duration()
+	writeTimeout := kingpin.Flag(
+		"web.write-timeout", "Maximum duration before timing out the write of a response, must exceed the time a scrape of libvirt takes",
+	).Default("2m").Duration()
 	toolkitFlags := webflag.AddFlags(kingpin.CommandLine, ":9177")
 
 	promlogConfig := &promlog.Config{}
@@ -1307,21 +4784,143 @@ func main() {
 	kingpin.HelpFlag.Short('h')
 	kingpin.Parse()
 	logger := promlog.New(promlogConfig)
+	uris := *libvirtURIs
+	if *uriGlob != "" {
+		globURIs, err := socketURIs(*uriGlob)
+		if err != nil {
+			_ = level.Error(logger).Log("msg", "invalid --libvirt.uri-glob", "err", err)
+			exit(1)
+		}
+		if !libvirtURIsSet {
+			uris = nil
+		}
+		uris = append(uris, globURIs...)
+		if len(uris) == 0 {
+			_ = level.Error(logger).Log("msg", "no libvirtd socket matches --libvirt.uri-glob", "glob", *uriGlob)
+			exit(1)
+		}
+	}
+	uris = uniqueURIs(uris)
+	uriLabelOnAll = len(uris) > 1
+	if !model.IsValidLegacyMetricName(model.LabelValue(*metricsNamespace)) {
+		_ = level.Error(logger).Log("msg", "invalid --metrics.namespace", "namespace", *metricsNamespace)
+		exit(1)
+	}
+	initDescs(*metricsNamespace)
 
 	_ = level.Info(logger).Log("msg", "Starting libvirt_exporter", "version", version.Info())
 	_ = level.Info(logger).Log("msg", "Build context", "build_context", version.BuildContext())
 
 	errorsMap = make(map[string]struct{})
 
-	exporter, err := NewLibvirtExporter(*libvirtURI, logger)
+	events, err := parsePerfEvents(*collectPerf)
 	if err != nil {
-		panic(err)
+		_ = level.Error(logger).Log("msg", "invalid --collect.perf", "err", err)
+		exit(1)
+	}
+	collectPerfEvents = events
+
+	if *tlsCert != "" || *tlsKey != "" || *tlsCACert != "" {
+		if *tlsCert == "" || *tlsKey == "" || *tlsCACert == "" {
+			_ = level.Error(logger).Log("msg", "--libvirt.tls.cert, --libvirt.tls.key and --libvirt.tls.cacert must be set together")
+			exit(1)
+		}
+		pkiPath, err := newPKIPath(*tlsCert, *tlsKey, *tlsCACert)
+		if err != nil {
+			_ = level.Error(logger).Log("msg", "failed to set up the libvirt TLS material", "err", err)
+			exit(1)
+		}
+		libvirtPKIPath = pkiPath
+		// The directory is removed by exit, which the signals stopping the
+		// exporter go through as well.
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			sig := <-signals
+			_ = level.Info(logger).Log("msg", "Received signal, exiting", "signal", sig)
+			exit(0)
+		}()
+	}
+	if *sshKeyFile != "" {
+		libvirtSSHParams.Set("keyfile", *sshKeyFile)
+	}
+	if *sshKnownHosts != "" {
+		libvirtSSHParams.Set("known_hosts", *sshKnownHosts)
+	}
+	if *sshNoVerify {
+		libvirtSSHParams.Set("no_verify", "1")
+	}
+
+	if *keepAliveInterval > 0 || *collectLifecycleEvents {
+		// libvirt only sends keepalive messages and delivers events while an
+		// event loop runs, and the loop has to be registered before
+		// connecting.
+		if err := libvirt.EventRegisterDefaultImpl(); err != nil {
+			_ = level.Error(logger).Log("msg", "failed to register the libvirt event loop", "err", err)
+			exit(1)
+		}
+		go func() {
+			for {
+				if err := libvirt.EventRunDefaultImpl(); err != nil {
+					_ = level.Error(logger).Log("msg", "failed to run the libvirt event loop", "err", err)
+					time.Sleep(eventLoopRetryDelay)
+				}
+			}
+		}()
+	}
+
+	// Every URI gets its own exporter, the registry collects them
+	// concurrently. They share the descriptors, told apart by the uri label
+	// the registerer wraps them with.
+	for _, uri := range uris {
+		exporter, err := NewLibvirtExporter(uri, *cacheTTL, *keepAliveInterval, *keepAliveCount, *connectTimeout, logger)
+		if err != nil {
+			panic(err)
+		}
+
+		labels := prometheus.Labels{}
+		if uriLabelOnAll {
+			labels["uri"] = uri
+		}
+		if *labelHostnameAll {
+			// The host label is constant for the lifetime of the exporter,
+			// so it is resolved once here rather than on every scrape.
+			host, err := resolveHostLabel(uri, *connectTimeout, logger)
+			if err != nil {
+				_ = level.Error(logger).Log("err", err)
+				exit(1)
+			}
+			labels["host"] = host
+		}
+		prometheus.WrapRegistererWith(labels, prometheus.DefaultRegisterer).MustRegister(exporter)
+	}
+	prometheus.MustRegister(versioncollector.NewCollector(*metricsNamespace + "_exporter"))
+	prometheus.MustRegister(libvirtAPICallDuration, libvirtAPICalls)
+	prometheus.MustRegister(newConfigInfo(uris, *cacheTTL, *connectTimeout))
+
+	gatherer := prometheus.Gatherer(prometheus.DefaultGatherer)
+	if len(*metricsInclude) > 0 || len(*metricsExclude) > 0 {
+		filter, err := newMetricFilter(prometheus.DefaultGatherer, *metricsInclude, *metricsExclude)
+		if err != nil {
+			_ = level.Error(logger).Log("err", err)
+			exit(1)
+		}
+		gatherer = filter
 	}
 
-	prometheus.MustRegister(exporter)
+	if *dryRun {
+		if err := writeMetricsOnce(os.Stdout, gatherer); err != nil {
+			_ = level.Error(logger).Log("err", err)
+			exit(1)
+		}
+		exit(0)
+	}
 
-	http.Handle(*metricsPath, promhttp.Handler())
-	if *metricsPath != "/" {
+	http.Handle(*metricsPath, promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}),
+	))
+	if *metricsPath != "/" && !*disableLandingPage {
 		landingCnf := web.LandingConfig{
 			Name:        "Libvirt Exporter",
 			Description: "Prometheus Libvirt Exporter",
@@ -1336,14 +4935,18 @@ func main() {
 		landingPage, err := web.NewLandingPage(landingCnf)
 		if err != nil {
 			_ = level.Error(logger).Log("err", err)
-			os.Exit(1)
+			exit(1)
 		}
 		http.Handle("/", landingPage)
 	}
 
-	srv := &http.Server{}
-	if err = web.ListenAndServe(srv, toolkitFlags, logger); err != nil {
+	srv := &http.Server{
+		ReadHeaderTimeout: *readHeaderTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+	}
+	if err := listenAndServe(srv, toolkitFlags, logger); err != nil {
 		_ = level.Error(logger).Log("err", err)
-		os.Exit(1)
+		exit(1)
 	}
 }
@@ -0,0 +1,683 @@
+// Copyright 2024 Kien Nguyen Tuan
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build cgo
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/exporter-toolkit/web"
+	"libvirt.org/go/libvirt"
+)
+
+func TestMain(m *testing.M) {
+	// The flags are package variables, they get their defaults as if the
+	// exporter was started without arguments.
+	if _, err := kingpin.CommandLine.Parse(nil); err != nil {
+		panic(err)
+	}
+	initDescs("libvirt")
+	errorsMap = make(map[string]struct{})
+	os.Exit(m.Run())
+}
+
+// testConnect opens libvirt's mock driver, which defines a running "test"
+// domain and a "default-pool" storage pool. The test is skipped where the
+// libvirt library can't be loaded.
+func testConnect(t *testing.T) *libvirt.Connect {
+	t.Helper()
+	conn, err := libvirt.NewConnect(string(TestDefault))
+	if err != nil {
+		t.Skipf("libvirt test driver unavailable: %s", err)
+	}
+	t.Cleanup(func() { _, _ = conn.Close() })
+	return conn
+}
+
+// gatherFamilies registers collector on a pedantic registry, which checks the
+// collected metrics against their descriptors, and gathers it by name.
+func gatherFamilies(t *testing.T, collector prometheus.Collector) map[string]*dto.MetricFamily {
+	t.Helper()
+	registry := prometheus.NewPedanticRegistry()
+	if err := registry.Register(collector); err != nil {
+		t.Fatalf("failed to register the collector: %s", err)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather: %s", err)
+	}
+	byName := make(map[string]*dto.MetricFamily, len(families))
+	for _, family := range families {
+		byName[family.GetName()] = family
+	}
+	return byName
+}
+
+// collectorFunc collects the metrics sent by a function, for the functions
+// collecting from libvirt.
+type collectorFunc struct {
+	describe func(ch chan<- *prometheus.Desc)
+	collect  func(ch chan<- prometheus.Metric)
+}
+
+func (c collectorFunc) Describe(ch chan<- *prometheus.Desc) { c.describe(ch) }
+
+func (c collectorFunc) Collect(ch chan<- prometheus.Metric) { c.collect(ch) }
+
+// collectFromLibvirt returns a collector running CollectFromLibvirt on conn,
+// failing the test if it fails.
+func collectFromLibvirt(t *testing.T, conn *libvirt.Connect, logger log.Logger) prometheus.Collector {
+	return collectorFunc{
+		describe: new(LibvirtExporter).Describe,
+		collect: func(ch chan<- prometheus.Metric) {
+			var summary scrapeSummary
+			if err := CollectFromLibvirt(ch, conn, string(TestDefault), newSampleStores(), &summary, logger); err != nil {
+				t.Errorf("CollectFromLibvirt failed: %s", err)
+			}
+		},
+	}
+}
+
+func TestCollectFromLibvirtTestDriver(t *testing.T) {
+	conn := testConnect(t)
+	families := gatherFamilies(t, collectFromLibvirt(t, conn, log.NewNopLogger()))
+
+	for _, name := range []string{
+		"libvirt_versions_info",
+		"libvirt_domain_info_meta",
+		"libvirt_domain_info_maximum_memory_bytes",
+		"libvirt_domain_info_memory_usage_bytes",
+		"libvirt_domain_info_virtual_cpus",
+		"libvirt_domain_info_cpu_time_seconds_total",
+		"libvirt_domain_info_vstate",
+		"libvirt_domain_scrape_duration_seconds",
+		"libvirt_pool_info_capacity_bytes",
+	} {
+		if _, ok := families[name]; !ok {
+			t.Errorf("metric family %s is missing", name)
+		}
+	}
+}
+
+func TestExporterTestDriver(t *testing.T) {
+	testConnect(t)
+	exporter, err := NewLibvirtExporter(string(TestDefault), 0, 0, 0, time.Second, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	families := gatherFamilies(t, exporter)
+
+	up, ok := families["libvirt_up"]
+	if !ok {
+		t.Fatal("metric family libvirt_up is missing")
+	}
+	if value := up.GetMetric()[0].GetGauge().GetValue(); value != 1 {
+		t.Errorf("libvirt_up is %v, want 1", value)
+	}
+	for _, name := range []string{"libvirt_up_error", "libvirt_last_scrape_success_timestamp_seconds", "libvirt_domain_info_meta"} {
+		if _, ok := families[name]; !ok {
+			t.Errorf("metric family %s is missing", name)
+		}
+	}
+}
+
+// setFlag sets a flag for the duration of the test.
+func setFlag[T any](t *testing.T, flag *T, value T) {
+	t.Helper()
+	previous := *flag
+	*flag = value
+	t.Cleanup(func() { *flag = previous })
+}
+
+func TestDomainStatsTypes(t *testing.T) {
+	base := libvirt.DOMAIN_STATS_STATE | libvirt.DOMAIN_STATS_CPU_TOTAL
+	for _, test := range []struct {
+		name string
+		set  func(t *testing.T)
+		want libvirt.DomainStatsTypes
+	}{
+		{"none", func(t *testing.T) {}, base},
+		{"vcpu", func(t *testing.T) { setFlag(t, collectVcpu, true) }, base | libvirt.DOMAIN_STATS_VCPU},
+		{"block", func(t *testing.T) { setFlag(t, collectBlock, true) }, base | libvirt.DOMAIN_STATS_BLOCK},
+		{"interface", func(t *testing.T) { setFlag(t, collectInterface, true) }, base | libvirt.DOMAIN_STATS_INTERFACE},
+		{"memory", func(t *testing.T) { setFlag(t, collectMemory, true) }, base | libvirt.DOMAIN_STATS_BALLOON},
+		{"perf", func(t *testing.T) { setFlag(t, &collectPerfEvents, []string{"cpu_cycles"}) }, base | libvirt.DOMAIN_STATS_PERF},
+		{"all", func(t *testing.T) {
+			setFlag(t, collectVcpu, true)
+			setFlag(t, collectBlock, true)
+			setFlag(t, collectInterface, true)
+			setFlag(t, collectMemory, true)
+			setFlag(t, &collectPerfEvents, []string{"cpu_cycles"})
+		}, base | libvirt.DOMAIN_STATS_VCPU | libvirt.DOMAIN_STATS_BLOCK | libvirt.DOMAIN_STATS_INTERFACE | libvirt.DOMAIN_STATS_BALLOON | libvirt.DOMAIN_STATS_PERF},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			setFlag(t, collectVcpu, false)
+			setFlag(t, collectBlock, false)
+			setFlag(t, collectInterface, false)
+			setFlag(t, collectMemory, false)
+			setFlag(t, &collectPerfEvents, nil)
+			test.set(t)
+			if got := domainStatsTypes(); got != test.want {
+				t.Errorf("domainStatsTypes() = %#x, want %#x", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRegisterExportersPerURI(t *testing.T) {
+	// As in main, the uri label is attached to all metrics by the
+	// registerer when several URIs are collected.
+	t.Cleanup(func() { initDescs("libvirt") })
+	setFlag(t, &uriLabelOnAll, true)
+	initDescs("libvirt")
+
+	registry := prometheus.NewRegistry()
+	for _, uri := range uniqueURIs([]string{"qemu:///system", "qemu:///session", "qemu:///system"}) {
+		exporter, err := NewLibvirtExporter(uri, 0, 0, 0, time.Second, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := prometheus.WrapRegistererWith(prometheus.Labels{"uri": uri}, registry).Register(exporter); err != nil {
+			t.Errorf("failed to register the exporter of %s: %s", uri, err)
+		}
+	}
+
+	exporter, err := NewLibvirtExporter("qemu:///system", 0, 0, 0, time.Second, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := prometheus.WrapRegistererWith(prometheus.Labels{"uri": "qemu:///system"}, registry).Register(exporter); err == nil {
+		t.Error("registering a second exporter of the same URI succeeded")
+	}
+}
+
+func TestUniqueURIs(t *testing.T) {
+	for _, test := range []struct {
+		uris []string
+		want []string
+	}{
+		{nil, []string{}},
+		{[]string{"qemu:///system"}, []string{"qemu:///system"}},
+		{[]string{"qemu:///system", "qemu:///session"}, []string{"qemu:///system", "qemu:///session"}},
+		{[]string{"qemu:///session", "qemu:///system", "qemu:///session"}, []string{"qemu:///session", "qemu:///system"}},
+	} {
+		got := uniqueURIs(test.uris)
+		if !slices.Equal(got, test.want) {
+			t.Errorf("uniqueURIs(%q) = %q, want %q", test.uris, got, test.want)
+		}
+	}
+}
+
+func TestDomainError(t *testing.T) {
+	noDomain := libvirt.Error{Code: libvirt.ERR_NO_DOMAIN, Message: "Domain not found"}
+	internal := libvirt.Error{Code: libvirt.ERR_INTERNAL_ERROR, Message: "internal error"}
+	for _, test := range []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"success", nil, nil},
+		{"no domain", noDomain, nil},
+		{"wrapped no domain", fmt.Errorf("GetXMLDesc: %w", noDomain), nil},
+		{"other error", internal, internal},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := domainError(test.err, log.NewNopLogger()); got != test.want {
+				t.Errorf("domainError(%v) = %v, want %v", test.err, got, test.want)
+			}
+		})
+	}
+}
+
+func TestCollectDomainsSkipsUndefinedDomain(t *testing.T) {
+	conn := testConnect(t)
+	var domains []*libvirt.Domain
+	for _, name := range []string{"staying", "vanishing"} {
+		domain, err := conn.DomainDefineXML(`<domain type='test'>
+  <name>` + name + `</name>
+  <memory>8192</memory>
+  <vcpu>1</vcpu>
+  <os><type>hvm</type></os>
+</domain>`)
+		if err != nil {
+			t.Fatalf("failed to define domain %s: %s", name, err)
+		}
+		t.Cleanup(func() {
+			_ = domain.Undefine()
+			_ = domain.Free()
+		})
+		domains = append(domains, domain)
+	}
+	stats, err := conn.GetAllDomainStats(domains, domainStatsTypes(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, stat := range stats {
+			_ = stat.Domain.Free()
+		}
+	})
+	// Gone after its stats were gathered, GetXMLDesc fails with ERR_NO_DOMAIN.
+	if err := domains[1].Undefine(); err != nil {
+		t.Fatal(err)
+	}
+
+	var summary scrapeSummary
+	collection := &domainCollection{samples: newSampleStores(), conn: conn}
+	families := gatherFamilies(t, collectorFunc{
+		describe: new(LibvirtExporter).Describe,
+		collect: func(ch chan<- prometheus.Metric) {
+			if err := collectDomains(ch, stats, collection, &summary, log.NewNopLogger()); err != nil {
+				t.Errorf("collectDomains failed: %s", err)
+			}
+		},
+	})
+
+	if summary.domainsFailed != 0 {
+		t.Errorf("%d domains failed, want 0", summary.domainsFailed)
+	}
+	var collected []string
+	for _, metric := range families["libvirt_domain_info_meta"].GetMetric() {
+		for _, label := range metric.GetLabel() {
+			if label.GetName() == "domain" {
+				collected = append(collected, label.GetValue())
+			}
+		}
+	}
+	if !slices.Equal(collected, []string{"staying"}) {
+		t.Errorf("collected domains %v, want [staying]", collected)
+	}
+}
+
+func TestIsTransientError(t *testing.T) {
+	rpc := libvirt.Error{Code: libvirt.ERR_RPC, Message: "connection reset"}
+	for _, test := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"rpc", rpc, true},
+		{"wrapped rpc", fmt.Errorf("GetInfo: %w", rpc), true},
+		{"no domain", libvirt.Error{Code: libvirt.ERR_NO_DOMAIN}, false},
+		{"not libvirt", io.EOF, false},
+	} {
+		if got := isTransientError(test.err); got != test.want {
+			t.Errorf("%s: isTransientError(%v) = %v, want %v", test.name, test.err, got, test.want)
+		}
+	}
+}
+
+func TestIsUnsupportedError(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"no support", libvirt.Error{Code: libvirt.ERR_NO_SUPPORT}, true},
+		{"operation unsupported", libvirt.Error{Code: libvirt.ERR_OPERATION_UNSUPPORTED}, true},
+		{"wrapped", fmt.Errorf("ListAllNodeDevices: %w", libvirt.Error{Code: libvirt.ERR_OPERATION_UNSUPPORTED}), true},
+		{"other error", libvirt.Error{Code: libvirt.ERR_INTERNAL_ERROR}, false},
+	} {
+		if got := isUnsupportedError(test.err); got != test.want {
+			t.Errorf("%s: isUnsupportedError(%v) = %v, want %v", test.name, test.err, got, test.want)
+		}
+	}
+}
+
+// apiCalls returns the number of calls to a libvirt API made so far.
+func apiCalls(t *testing.T, call string) float64 {
+	t.Helper()
+	var calls float64
+	for _, result := range []string{"success", "error"} {
+		var metric dto.Metric
+		if err := libvirtAPICalls.WithLabelValues(call, result).Write(&metric); err != nil {
+			t.Fatal(err)
+		}
+		calls += metric.GetCounter().GetValue()
+	}
+	return calls
+}
+
+func TestCollectFromLibvirtSkipsQEMUPaths(t *testing.T) {
+	conn := testConnect(t)
+	// Reading procfs or asking the QEMU monitor and guest agent would fail
+	// and be logged.
+	setFlag(t, procFSPath, filepath.Join(t.TempDir(), "proc"))
+	setFlag(t, collectVcpu, true)
+	setFlag(t, collectGuestAgent, true)
+	setFlag(t, &collectPerfEvents, []string{"cpu_cycles"})
+	setFlag(t, &errorsMap, make(map[string]struct{}))
+	monitorCalls, agentCalls := apiCalls(t, "QemuMonitorCommand"), apiCalls(t, "QemuAgentCommand")
+
+	var logs bytes.Buffer
+	families := gatherFamilies(t, collectFromLibvirt(t, conn, log.NewLogfmtLogger(&logs)))
+
+	if _, ok := families["libvirt_domain_info_meta"]; !ok {
+		t.Error("metric family libvirt_domain_info_meta is missing")
+	}
+	if calls := apiCalls(t, "QemuMonitorCommand"); calls != monitorCalls {
+		t.Errorf("QEMU monitor asked %v times for a test driver domain", calls-monitorCalls)
+	}
+	if calls := apiCalls(t, "QemuAgentCommand"); calls != agentCalls {
+		t.Errorf("QEMU guest agent asked %v times for a test driver domain", calls-agentCalls)
+	}
+	if strings.Contains(logs.String(), "level=error") {
+		t.Errorf("errors logged for the test driver:\n%s", logs.String())
+	}
+}
+
+func TestCollectDomainShutoff(t *testing.T) {
+	conn := testConnect(t)
+	domain, err := conn.DomainDefineXML(`<domain type='test'>
+  <name>shutoff</name>
+  <memory>8192</memory>
+  <vcpu>2</vcpu>
+  <os><type>hvm</type></os>
+</domain>`)
+	if err != nil {
+		t.Fatalf("failed to define a shut off domain: %s", err)
+	}
+	t.Cleanup(func() {
+		_ = domain.Undefine()
+		_ = domain.Free()
+	})
+	setFlag(t, collectVcpu, true)
+	stats, err := conn.GetAllDomainStats([]*libvirt.Domain{domain}, domainStatsTypes(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, stat := range stats {
+			_ = stat.Domain.Free()
+		}
+	})
+
+	// Taken for a QEMU domain, a running one would have its vcpu threads
+	// read from procfs or asked from the monitor.
+	setFlag(t, procFSPath, filepath.Join(t.TempDir(), "proc"))
+	setFlag(t, &errorsMap, make(map[string]struct{}))
+	monitorCalls := apiCalls(t, "QemuMonitorCommand")
+	var logs bytes.Buffer
+	logger := log.NewLogfmtLogger(&logs)
+	collection := &domainCollection{driver: qemuDriver, processes: []int{1}, samples: newSampleStores(), conn: conn}
+	families := gatherFamilies(t, collectorFunc{
+		describe: new(LibvirtExporter).Describe,
+		collect: func(ch chan<- prometheus.Metric) {
+			for _, stat := range stats {
+				if err := CollectDomain(ch, stat, collection, logger); err != nil {
+					t.Errorf("CollectDomain failed: %s", err)
+				}
+			}
+		},
+	})
+
+	if _, ok := families["libvirt_domain_info_meta"]; !ok {
+		t.Error("metric family libvirt_domain_info_meta is missing")
+	}
+	for _, name := range []string{"libvirt_domain_vcpu_delay_seconds_total", "libvirt_domain_vcpu_state", "libvirt_domain_vcpu_time_seconds_total"} {
+		if _, ok := families[name]; ok {
+			t.Errorf("metric family %s exported for a shut off domain", name)
+		}
+	}
+	if calls := apiCalls(t, "QemuMonitorCommand"); calls != monitorCalls {
+		t.Errorf("QEMU monitor asked %v times for a shut off domain", calls-monitorCalls)
+	}
+	if strings.Contains(logs.String(), "level=error") {
+		t.Errorf("errors logged for a shut off domain:\n%s", logs.String())
+	}
+}
+
+func TestMustNewConstMetricCountersAsGauge(t *testing.T) {
+	desc := prometheus.NewDesc("libvirt_test_total", "Test counter.", nil, nil)
+	for _, test := range []struct {
+		name            string
+		countersAsGauge bool
+		valueType       prometheus.ValueType
+		wantGauge       bool
+	}{
+		{"counter", false, prometheus.CounterValue, false},
+		{"gauge", false, prometheus.GaugeValue, true},
+		{"counter as gauge", true, prometheus.CounterValue, true},
+		{"gauge as gauge", true, prometheus.GaugeValue, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			setFlag(t, metricsCountersAsGauge, test.countersAsGauge)
+			var metric dto.Metric
+			if err := mustNewConstMetric(desc, test.valueType, 42).Write(&metric); err != nil {
+				t.Fatal(err)
+			}
+			if gauge := metric.GetGauge() != nil; gauge != test.wantGauge {
+				t.Errorf("gauge = %v, want %v", gauge, test.wantGauge)
+			}
+			if counter := metric.GetCounter() != nil; counter == test.wantGauge {
+				t.Errorf("counter = %v, want %v", counter, !test.wantGauge)
+			}
+		})
+	}
+}
+
+func TestMemoryStatValue(t *testing.T) {
+	for _, test := range []struct {
+		tag  libvirt.DomainMemoryStatTags
+		want uint64
+	}{
+		// Counts
+		{libvirt.DOMAIN_MEMORY_STAT_MAJOR_FAULT, 3},
+		{libvirt.DOMAIN_MEMORY_STAT_MINOR_FAULT, 3},
+		{libvirt.DOMAIN_MEMORY_STAT_HUGETLB_PGALLOC, 3},
+		{libvirt.DOMAIN_MEMORY_STAT_HUGETLB_PGFAIL, 3},
+		// Seconds since the epoch
+		{libvirt.DOMAIN_MEMORY_STAT_LAST_UPDATE, 3},
+		// KiB
+		{libvirt.DOMAIN_MEMORY_STAT_SWAP_IN, 3 * 1024},
+		{libvirt.DOMAIN_MEMORY_STAT_SWAP_OUT, 3 * 1024},
+		{libvirt.DOMAIN_MEMORY_STAT_UNUSED, 3 * 1024},
+		{libvirt.DOMAIN_MEMORY_STAT_AVAILABLE, 3 * 1024},
+		{libvirt.DOMAIN_MEMORY_STAT_ACTUAL_BALLOON, 3 * 1024},
+		{libvirt.DOMAIN_MEMORY_STAT_RSS, 3 * 1024},
+		{libvirt.DOMAIN_MEMORY_STAT_USABLE, 3 * 1024},
+		{libvirt.DOMAIN_MEMORY_STAT_DISK_CACHES, 3 * 1024},
+	} {
+		if got := memoryStatValue(test.tag, 3); got != test.want {
+			t.Errorf("memoryStatValue(%d, 3) = %d, want %d", test.tag, got, test.want)
+		}
+	}
+}
+
+func TestListenAndServeUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "exporter.sock")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "libvirt_up 1\n")
+	})
+	server := &http.Server{Handler: mux}
+	systemdSocket := false
+	webConfigFile := ""
+	flags := &web.FlagConfig{
+		WebListenAddresses: &[]string{"unix://" + socket},
+		WebSystemdSocket:   &systemdSocket,
+		WebConfigFile:      &webConfigFile,
+	}
+	served := make(chan error, 1)
+	go func() { served <- listenAndServe(server, flags, log.NewNopLogger()) }()
+	t.Cleanup(func() {
+		_ = server.Close()
+		if err := <-served; err != http.ErrServerClosed {
+			t.Errorf("listenAndServe failed: %v", err)
+		}
+	})
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	var response *http.Response
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if response, err = client.Get("http://localhost/metrics"); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("failed to get the metrics over the unix socket: %s", err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK || string(body) != "libvirt_up 1\n" {
+		t.Errorf("got %d %q, want 200 %q", response.StatusCode, body, "libvirt_up 1\n")
+	}
+}
+
+func TestTruncateLabelValue(t *testing.T) {
+	prefix := strings.Repeat("/var/lib/nova/instances/", 20)
+	first := truncateLabelValue(prefix+"disk", 64)
+	second := truncateLabelValue(prefix+"disk.config", 64)
+	if first == second {
+		t.Errorf("values sharing a prefix truncated to the same %q", first)
+	}
+	for _, truncated := range []string{first, second} {
+		if length := utf8.RuneCountInString(truncated); length != 64 {
+			t.Errorf("%q is %d runes long, want 64", truncated, length)
+		}
+		if !strings.HasPrefix(truncated, prefix[:55]) {
+			t.Errorf("%q doesn't start with the value", truncated)
+		}
+	}
+	if again := truncateLabelValue(prefix+"disk", 64); again != first {
+		t.Errorf("truncating the same value gave %q then %q", first, again)
+	}
+}
+
+func TestSampleStorePrune(t *testing.T) {
+	store := &sampleStore[string, uint64]{}
+	store.set("stale", 1)
+	store.set("fresh", 2)
+	// Backdate the samples rather than sleep between them.
+	before := time.Now()
+	store.samples["stale"] = storedSample[uint64]{value: 1, seen: before.Add(-time.Second)}
+	store.samples["fresh"] = storedSample[uint64]{value: 2, seen: before}
+
+	store.prune(before)
+	if _, _, ok := store.get("stale"); ok {
+		t.Error("stale sample not pruned")
+	}
+	if value, seen, ok := store.get("fresh"); !ok || value != 2 || !seen.Equal(before) {
+		t.Errorf("fresh sample = %d, %v, %v, want 2, %v, true", value, seen, ok, before)
+	}
+}
+
+func TestBlockLatency(t *testing.T) {
+	store := &sampleStore[string, blockRequests]{}
+	if _, ok := blockLatency(store, "vda", 10, 1e9); ok {
+		t.Error("latency of the first sample")
+	}
+	if latency, ok := blockLatency(store, "vda", 20, 3e9); !ok || latency != 0.2 {
+		t.Errorf("latency = %v, %v, want 0.2, true", latency, ok)
+	}
+	if latency, ok := blockLatency(store, "vda", 20, 3e9); !ok || latency != 0 {
+		t.Errorf("idle latency = %v, %v, want 0, true", latency, ok)
+	}
+	if _, ok := blockLatency(store, "vda", 5, 1e9); ok {
+		t.Error("latency across a counter reset")
+	}
+}
+
+func TestCollectLifecycleEventsForgetsGoneDomains(t *testing.T) {
+	setFlag(t, collectLifecycleEvents, true)
+	e, err := NewLibvirtExporter(string(TestDefault), 0, 0, 0, time.Second, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.samples.novaNames.set("kept-uuid", "nova-kept")
+	e.lastEvents[lifecycleEventKey{name: "kept", uuid: "kept-uuid", event: "started"}] = time.Now()
+	e.lastEvents[lifecycleEventKey{name: "gone", uuid: "gone-uuid", event: "undefined"}] = time.Now()
+	collector := collectorFunc{describe: e.Describe, collect: e.collectLifecycleEvents}
+
+	// The event of the domain gone is exported once.
+	for scrape, want := range []int{2, 1} {
+		families := gatherFamilies(t, collector)
+		if got := len(families["libvirt_domain_last_lifecycle_event_timestamp_seconds"].GetMetric()); got != want {
+			t.Errorf("scrape %d: %d lifecycle events, want %d", scrape, got, want)
+		}
+	}
+}
+
+func TestConfigInfoNamespace(t *testing.T) {
+	setFlag(t, metricsNamespace, "kvm")
+	families := gatherFamilies(t, newConfigInfo([]string{"qemu:///system"}, 0, time.Second))
+	if _, ok := families["kvm_exporter_config_info"]; !ok {
+		t.Errorf("kvm_exporter_config_info not gathered, got %d families", len(families))
+	}
+}
+
+func TestUpErrorReason(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"no error", nil, ""},
+		{"connect", &scrapeError{reason: connectErrorReason(libvirt.Error{Code: libvirt.ERR_SYSTEM_ERROR}), err: libvirt.Error{Code: libvirt.ERR_SYSTEM_ERROR}}, "connect"},
+		{"auth", &scrapeError{reason: connectErrorReason(libvirt.Error{Code: libvirt.ERR_AUTH_FAILED}), err: libvirt.Error{Code: libvirt.ERR_AUTH_FAILED}}, "auth"},
+		// GetVersion, GetLibVersion and GetType
+		{"version", &scrapeError{reason: "version", err: libvirt.Error{Code: libvirt.ERR_NO_SUPPORT}}, "version"},
+		{"wrapped version", fmt.Errorf("scrape: %w", &scrapeError{reason: "version", err: libvirt.Error{Code: libvirt.ERR_NO_SUPPORT}}), "version"},
+		{"stats", libvirt.Error{Code: libvirt.ERR_INTERNAL_ERROR}, "stats"},
+	} {
+		if got := upErrorReason(test.err); got != test.want {
+			t.Errorf("%s: upErrorReason() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestWithTransportParamsSSH(t *testing.T) {
+	setFlag(t, &libvirtSSHParams, url.Values{"keyfile": {"/key"}, "known_hosts": {"/known_hosts"}})
+	for _, test := range []struct {
+		uri  string
+		want string
+	}{
+		{"qemu+ssh://hv1/system", "qemu+ssh://hv1/system?keyfile=%2Fkey"},
+		{"qemu+libssh://hv1/system", "qemu+libssh://hv1/system?keyfile=%2Fkey&known_hosts=%2Fknown_hosts"},
+		{"qemu+libssh2://hv1/system", "qemu+libssh2://hv1/system?keyfile=%2Fkey&known_hosts=%2Fknown_hosts"},
+		{"qemu+tcp://hv1/system", "qemu+tcp://hv1/system"},
+		{"qemu:///system", "qemu:///system"},
+	} {
+		got, err := withTransportParams(test.uri)
+		if err != nil || got != test.want {
+			t.Errorf("withTransportParams(%q) = %q, %v, want %q", test.uri, got, err, test.want)
+		}
+	}
+}
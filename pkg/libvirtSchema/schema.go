@@ -16,9 +16,97 @@
 
 package libvirtSchema
 
+import "encoding/xml"
+
 type Domain struct {
-	Devices  Devices  `xml:"devices"`
-	Metadata Metadata `xml:"metadata"`
+	OS            OS            `xml:"os"`
+	Features      Features      `xml:"features"`
+	CPU           CPU           `xml:"cpu"`
+	MemoryBacking MemoryBacking `xml:"memoryBacking"`
+	Devices       Devices       `xml:"devices"`
+	SecLabels     []SecLabel    `xml:"seclabel"`
+	Metadata      Metadata      `xml:"metadata"`
+}
+
+type CPU struct {
+	Mode     string      `xml:"mode,attr"`
+	Model    string      `xml:"model"`
+	Topology CPUTopology `xml:"topology"`
+	NUMA     []NUMACell  `xml:"numa>cell"`
+}
+
+type NUMACell struct {
+	ID     string `xml:"id,attr"`
+	Memory uint64 `xml:"memory,attr"`
+	Unit   string `xml:"unit,attr"`
+}
+
+type CPUTopology struct {
+	Sockets string `xml:"sockets,attr"`
+	Cores   string `xml:"cores,attr"`
+	Threads string `xml:"threads,attr"`
+}
+
+type Features struct {
+	HyperV HyperV `xml:"hyperv"`
+}
+
+type HyperV struct {
+	Mode     string          `xml:"mode,attr"`
+	Features []HyperVFeature `xml:",any"`
+}
+
+type HyperVFeature struct {
+	XMLName xml.Name
+	State   string `xml:"state,attr"`
+}
+
+type SecLabel struct {
+	Type    string `xml:"type,attr"`
+	Model   string `xml:"model,attr"`
+	Relabel string `xml:"relabel,attr"`
+}
+
+type MemoryBacking struct {
+	Source    MemoryBackingSource `xml:"source"`
+	Hugepages *Hugepages          `xml:"hugepages"`
+}
+
+type Hugepages struct {
+	Pages []HugepagesPage `xml:"page"`
+}
+
+type HugepagesPage struct {
+	Nodeset string `xml:"nodeset,attr"`
+}
+
+type MemoryBackingSource struct {
+	Type string `xml:"type,attr"`
+}
+
+type OS struct {
+	Type     OSType   `xml:"type"`
+	Loader   Loader   `xml:"loader"`
+	Firmware Firmware `xml:"firmware"`
+}
+
+type OSType struct {
+	Arch    string `xml:"arch,attr"`
+	Machine string `xml:"machine,attr"`
+	Type    string `xml:",chardata"`
+}
+
+type Loader struct {
+	Secure string `xml:"secure,attr"`
+}
+
+type Firmware struct {
+	Features []FirmwareFeature `xml:"feature"`
+}
+
+type FirmwareFeature struct {
+	Name    string `xml:"name,attr"`
+	Enabled string `xml:"enabled,attr"`
 }
 
 type Metadata struct {
@@ -57,8 +145,152 @@ type Root struct {
 }
 
 type Devices struct {
-	Disks      []Disk      `xml:"disk"`
-	Interfaces []Interface `xml:"interface"`
+	Disks       []Disk       `xml:"disk"`
+	Interfaces  []Interface  `xml:"interface"`
+	TPMs        []TPM        `xml:"tpm"`
+	Watchdogs   []Watchdog   `xml:"watchdog"`
+	RNGs        []RNG        `xml:"rng"`
+	Controllers []Controller `xml:"controller"`
+	Hostdevs    []Hostdev    `xml:"hostdev"`
+	Filesystems []Filesystem `xml:"filesystem"`
+	Graphics    []Graphics   `xml:"graphics"`
+	Videos      []Video      `xml:"video"`
+	MemBalloon  MemBalloon   `xml:"memballoon"`
+	Channels    []CharDevice `xml:"channel"`
+	Consoles    []CharDevice `xml:"console"`
+	Vsock       *Vsock       `xml:"vsock"`
+	Sounds      []Peripheral `xml:"sound"`
+	Inputs      []Peripheral `xml:"input"`
+	Redirdevs   []Peripheral `xml:"redirdev"`
+}
+
+type Peripheral struct {
+	Type  string `xml:"type,attr"`
+	Bus   string `xml:"bus,attr"`
+	Model string `xml:"model,attr"`
+}
+
+type Vsock struct {
+	Model string   `xml:"model,attr"`
+	CID   VsockCID `xml:"cid"`
+}
+
+type VsockCID struct {
+	Auto    string `xml:"auto,attr"`
+	Address string `xml:"address,attr"`
+}
+
+type CharDevice struct {
+	Type   string           `xml:"type,attr"`
+	Target CharDeviceTarget `xml:"target"`
+}
+
+type CharDeviceTarget struct {
+	Type  string `xml:"type,attr"`
+	Name  string `xml:"name,attr"`
+	State string `xml:"state,attr"`
+}
+
+type MemBalloon struct {
+	Model string          `xml:"model,attr"`
+	Stats MemBalloonStats `xml:"stats"`
+}
+
+type MemBalloonStats struct {
+	Period string `xml:"period,attr"`
+}
+
+type Graphics struct {
+	Type    string           `xml:"type,attr"`
+	Port    string           `xml:"port,attr"`
+	Listen  string           `xml:"listen,attr"`
+	Listens []GraphicsListen `xml:"listen"`
+}
+
+type GraphicsListen struct {
+	Address string `xml:"address,attr"`
+}
+
+type Video struct {
+	Model VideoModel `xml:"model"`
+}
+
+type VideoModel struct {
+	Type string `xml:"type,attr"`
+}
+
+type TPM struct {
+	Model string `xml:"model,attr"`
+}
+
+type Watchdog struct {
+	Model  string `xml:"model,attr"`
+	Action string `xml:"action,attr"`
+}
+
+type RNG struct {
+	Model   string     `xml:"model,attr"`
+	Backend RNGBackend `xml:"backend"`
+}
+
+type RNGBackend struct {
+	Model string `xml:"model,attr"`
+}
+
+type Filesystem struct {
+	Driver FilesystemDriver `xml:"driver"`
+	Source FilesystemSource `xml:"source"`
+	Target FilesystemTarget `xml:"target"`
+}
+
+type FilesystemDriver struct {
+	Type string `xml:"type,attr"`
+}
+
+type FilesystemSource struct {
+	Dir string `xml:"dir,attr"`
+}
+
+type FilesystemTarget struct {
+	Dir string `xml:"dir,attr"`
+}
+
+type Controller struct {
+	Type  string `xml:"type,attr"`
+	Index string `xml:"index,attr"`
+	Model string `xml:"model,attr"`
+}
+
+type Hostdev struct {
+	Mode   string        `xml:"mode,attr"`
+	Type   string        `xml:"type,attr"`
+	Source HostdevSource `xml:"source"`
+}
+
+type HostdevSource struct {
+	Address HostdevAddress `xml:"address"`
+	Adapter HostdevAdapter `xml:"adapter"`
+	Vendor  HostdevID      `xml:"vendor"`
+	Product HostdevID      `xml:"product"`
+}
+
+type HostdevAddress struct {
+	Domain   string `xml:"domain,attr"`
+	Bus      string `xml:"bus,attr"`
+	Slot     string `xml:"slot,attr"`
+	Function string `xml:"function,attr"`
+	Device   string `xml:"device,attr"`
+	Target   string `xml:"target,attr"`
+	Unit     string `xml:"unit,attr"`
+	UUID     string `xml:"uuid,attr"`
+}
+
+type HostdevAdapter struct {
+	Name string `xml:"name,attr"`
+}
+
+type HostdevID struct {
+	ID string `xml:"id,attr"`
 }
 
 type Disk struct {
@@ -68,28 +300,77 @@ type Disk struct {
 	Target   DiskTarget `xml:"target"`
 	DiskType string     `xml:"type,attr"`
 	Serial   string     `xml:"serial"`
+	WWN      string     `xml:"wwn"`
+	ReadOnly *struct{}  `xml:"readonly"`
+	Boot     Boot       `xml:"boot"`
+	BlockIO  BlockIO    `xml:"blockio"`
+}
+
+type BlockIO struct {
+	LogicalBlockSize   string `xml:"logical_block_size,attr"`
+	PhysicalBlockSize  string `xml:"physical_block_size,attr"`
+	DiscardGranularity string `xml:"discard_granularity,attr"`
+}
+
+type Boot struct {
+	Order string `xml:"order,attr"`
 }
 
 type DiskDriver struct {
-	Type    string `xml:"type,attr"`
-	Cache   string `xml:"cache,attr"`
-	Discard string `xml:"discard,attr"`
+	Type      string         `xml:"type,attr"`
+	Cache     string         `xml:"cache,attr"`
+	Discard   string         `xml:"discard,attr"`
+	Queues    string         `xml:"queues,attr"`
+	IOThread  string         `xml:"iothread,attr"`
+	IOThreads []DiskIOThread `xml:"iothreads>iothread"`
+}
+
+type DiskIOThread struct {
+	ID string `xml:"id,attr"`
 }
 
 type DiskSource struct {
-	File string `xml:"file,attr"`
-	Name string `xml:"name,attr"`
+	File     string `xml:"file,attr"`
+	Name     string `xml:"name,attr"`
+	Protocol string `xml:"protocol,attr"`
+	Pool     string `xml:"pool,attr"`
+	Volume   string `xml:"volume,attr"`
 }
 
 type DiskTarget struct {
-	Device string `xml:"dev,attr"`
-	Bus    string `xml:"bus,attr"`
+	Device       string `xml:"dev,attr"`
+	Bus          string `xml:"bus,attr"`
+	RotationRate string `xml:"rotation_rate,attr"`
 }
 
 type Interface struct {
 	Source      InterfaceSource      `xml:"source"`
 	Target      InterfaceTarget      `xml:"target"`
 	Virtualport InterfaceVirtualPort `xml:"virtualport"`
+	Bandwidth   InterfaceBandwidth   `xml:"bandwidth"`
+	MAC         InterfaceMAC         `xml:"mac"`
+	Boot        Boot                 `xml:"boot"`
+	Driver      InterfaceDriver      `xml:"driver"`
+}
+
+type InterfaceDriver struct {
+	Name   string `xml:"name,attr"`
+	Queues string `xml:"queues,attr"`
+}
+
+type InterfaceMAC struct {
+	Address string `xml:"address,attr"`
+}
+
+type InterfaceBandwidth struct {
+	Inbound  InterfaceBandwidthLimit `xml:"inbound"`
+	Outbound InterfaceBandwidthLimit `xml:"outbound"`
+}
+
+type InterfaceBandwidthLimit struct {
+	Average string `xml:"average,attr"`
+	Peak    string `xml:"peak,attr"`
+	Burst   string `xml:"burst,attr"`
 }
 
 type InterfaceVirtualPort struct {
@@ -116,4 +397,27 @@ type VirDomainMemoryStats struct {
 	Rss           uint64
 	Usable        uint64
 	DiskCaches    uint64
+	LastUpdate    uint64
+}
+
+type NodeDevice struct {
+	Name         string                 `xml:"name"`
+	Driver       NodeDeviceDriver       `xml:"driver"`
+	Capabilities []NodeDeviceCapability `xml:"capability"`
+}
+
+type NodeDeviceDriver struct {
+	Name string `xml:"name"`
+}
+
+type NodeDeviceCapability struct {
+	Type         string                 `xml:"type,attr"`
+	Capabilities []NodeDeviceCapability `xml:"capability"`
+	MdevTypes    []NodeDeviceMdevType   `xml:"type"`
+}
+
+type NodeDeviceMdevType struct {
+	ID                 string `xml:"id,attr"`
+	Name               string `xml:"name"`
+	AvailableInstances uint64 `xml:"availableInstances"`
 }
@@ -3,10 +3,13 @@ package utils
 import (
 	"bytes"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+
+	"github.com/prometheus/procfs"
+	"golang.org/x/sys/unix"
 )
 
 // ProcPIDSchedStat defines the fields of a /proc/[pid]/schedstat file
@@ -26,9 +29,12 @@ type ProcPIDSchedStat struct {
 func GetProcPIDSchedStat(procPath string, pid int) (*ProcPIDSchedStat, error) {
 	stats := &ProcPIDSchedStat{PID: pid}
 	schedStatPath := filepath.Join(procPath, strconv.Itoa(pid), "schedstat")
-	filecontent, _ := os.ReadFile(schedStatPath)
+	filecontent, err := os.ReadFile(schedStatPath)
+	if err != nil {
+		return nil, err
+	}
 
-	_, err := fmt.Fscan(
+	_, err = fmt.Fscan(
 		bytes.NewBuffer(filecontent),
 		&stats.Cputime,
 		&stats.Runqueue,
@@ -42,6 +48,41 @@ func GetProcPIDSchedStat(procPath string, pid int) (*ProcPIDSchedStat, error) {
 	return stats, err
 }
 
+// GetProcPIDStat reads and returns the stat of a process from the proc fs
+func GetProcPIDStat(procPath string, pid int) (procfs.ProcStat, error) {
+	fs, err := procfs.NewFS(procPath)
+	if err != nil {
+		return procfs.ProcStat{}, err
+	}
+	proc, err := fs.Proc(pid)
+	if err != nil {
+		return procfs.ProcStat{}, err
+	}
+	return proc.Stat()
+}
+
+// GetProcPIDFDs returns the number of open file descriptors of a process and
+// its limit on them from the proc fs
+func GetProcPIDFDs(procPath string, pid int) (int, uint64, error) {
+	fs, err := procfs.NewFS(procPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	proc, err := fs.Proc(pid)
+	if err != nil {
+		return 0, 0, err
+	}
+	open, err := proc.FileDescriptorsLen()
+	if err != nil {
+		return 0, 0, err
+	}
+	limits, err := proc.Limits()
+	if err != nil {
+		return 0, 0, err
+	}
+	return open, limits.OpenFiles, nil
+}
+
 // GetCmdLine reads the cmdline for a process from /proc
 func GetCmdLine(procPath string, pid int) string {
 	cmdLinePath := filepath.Join(procPath, strconv.Itoa(pid), "cmdline")
@@ -50,10 +91,10 @@ func GetCmdLine(procPath string, pid int) string {
 }
 
 // GetProcessList reads and returns all PIDs from the proc filesystem
-func GetProcessList(procFS string) []int {
+func GetProcessList(procFS string) ([]int, error) {
 	files, err := os.ReadDir(procFS)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	var processes []int
@@ -68,5 +109,113 @@ func GetProcessList(procFS string) []int {
 		}
 	}
 
-	return processes
+	return processes, nil
+}
+
+// GetNetDevStatistics reads and returns the counters of a network device from
+// the sys fs, indexed by the file names in its statistics directory
+func GetNetDevStatistics(sysPath, device string) (map[string]uint64, error) {
+	statisticsPath := filepath.Join(sysPath, "class", "net", device, "statistics")
+	files, err := os.ReadDir(statisticsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	statistics := make(map[string]uint64, len(files))
+	for _, f := range files {
+		filecontent, err := os.ReadFile(filepath.Join(statisticsPath, f.Name()))
+		if err != nil {
+			continue
+		}
+		value, err := strconv.ParseUint(string(bytes.TrimSpace(filecontent)), 10, 64)
+		if err != nil {
+			continue
+		}
+		statistics[f.Name()] = value
+	}
+
+	return statistics, nil
+}
+
+// BlockDevStat defines the queue fields of a /sys/block/<dev>/stat file
+// cf. https://www.kernel.org/doc/Documentation/block/stat.txt
+type BlockDevStat struct {
+	// number of I/Os currently in flight
+	InFlight uint64
+	// milliseconds spent doing I/Os
+	IOTicks uint64
+	// milliseconds spent by all the I/Os, in flight ones included
+	TimeInQueue uint64
+}
+
+// GetBlockDevStat reads and returns the stat of the host block device backing
+// a path from the sys fs. For a block device node that is the device itself,
+// for a regular file it's the device of the filesystem holding it, a loop
+// device or a partition for instance.
+func GetBlockDevStat(sysPath, path string) (*BlockDevStat, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return nil, err
+	}
+	dev := uint64(st.Dev)
+	if st.Mode&unix.S_IFMT == unix.S_IFBLK {
+		dev = uint64(st.Rdev)
+	}
+	statPath := filepath.Join(sysPath, "dev", "block", fmt.Sprintf("%d:%d", unix.Major(dev), unix.Minor(dev)), "stat")
+	filecontent, err := os.ReadFile(statPath)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Fields(string(filecontent))
+	if len(fields) < 11 {
+		return nil, fmt.Errorf("unexpected format of %s", statPath)
+	}
+	var values [3]uint64
+	for i := range values {
+		values[i], err = strconv.ParseUint(fields[8+i], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &BlockDevStat{
+		InFlight:    values[0],
+		IOTicks:     values[1],
+		TimeInQueue: values[2],
+	}, nil
+}
+
+// GetVcpuThreadIDs returns the thread ids of the vcpus of a QEMU process,
+// indexed by vcpu number. QEMU names its vcpu threads "CPU <n>/KVM" (or
+// "CPU <n>/TCG"), so they are found by the comm of the tasks of the process.
+// A vcpu without a thread has a zero thread id.
+func GetVcpuThreadIDs(procPath string, pid int) ([]int, error) {
+	taskPath := filepath.Join(procPath, strconv.Itoa(pid), "task")
+	tasks, err := os.ReadDir(taskPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var threadIDs []int
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		comm, err := os.ReadFile(filepath.Join(taskPath, task.Name(), "comm"))
+		if err != nil {
+			continue
+		}
+		var vcpu int
+		if _, err := fmt.Sscanf(string(comm), "CPU %d/", &vcpu); err != nil || vcpu < 0 {
+			continue
+		}
+		for len(threadIDs) <= vcpu {
+			threadIDs = append(threadIDs, 0)
+		}
+		threadIDs[vcpu] = tid
+	}
+
+	return threadIDs, nil
 }